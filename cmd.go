@@ -2,26 +2,32 @@ package main
 
 import (
 	"archive/tar"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/alecthomas/kong"
-	aferoguestfs "github.com/gaboose/afero-guestfs"
 	"github.com/gaboose/aferosync"
+	"github.com/gaboose/pipod/internal/bmap"
+	"github.com/gaboose/pipod/internal/event"
+	"github.com/gaboose/pipod/internal/growfs"
 	"github.com/gaboose/pipod/internal/guestfish"
 	"github.com/gaboose/pipod/internal/iio"
+	"github.com/gaboose/pipod/internal/platform"
 	"github.com/gaboose/pipod/internal/podman"
 	"github.com/gaboose/pipod/internal/wifi"
-	"github.com/mholt/archives"
-	"github.com/pelletier/go-toml/v2"
 	"github.com/spf13/afero"
-)
-
-const (
-	TEMP_DIR = "tmp"
+	"golang.org/x/sync/errgroup"
 )
 
 type ContainerCmd struct {
@@ -29,131 +35,258 @@ type ContainerCmd struct {
 }
 
 type ContainerBuildCmd struct {
-	Spec     string `default:"pipod.toml" help:"Path to pipod.toml" type:"existingfile"`
-	Tag      string `short:"t" help:"Tagged name to apply to the built image"`
-	Manifest string `help:"Add the images to a manifest list. Creates manifest list if it does not exist"`
+	Spec                string            `default:"pipod.toml" help:"Path to pipod.toml" type:"existingfile"`
+	Tag                 []string          `short:"t" help:"Tagged name to apply to the built image, or to the manifest list of a multi-platform build. Can be repeated"`
+	PlatformTagTemplate string            `default:"${defaultPlatformTagTemplate}" help:"Go template of the tags of the platform images of a multi-platform build, executed on every --tag with .Repo, .Tag, .OS, .Arch and .Variant"`
+	Manifest            string            `help:"Add the images to a manifest list. Creates manifest list if it does not exist (default: the first --tag of a multi-platform build)"`
+	Jobs                int               `short:"j" help:"Number of platforms to build in parallel (default: all)"`
+	Set                 map[string]string `help:"Set a build spec variable (key=value), overriding its [vars] value"`
 }
 
-func (b *ContainerBuildCmd) Run() error {
-	tomlBts, err := os.ReadFile(b.Spec)
+func (b *ContainerBuildCmd) Run(ctx context.Context, globals *Globals) error {
+	spec, err := loadSpec(b.Spec, b.Set)
 	if err != nil {
-		return fmt.Errorf("failed to read toml: %w", err)
+		return err
 	}
 
-	var spec Spec
-	if err := toml.Unmarshal(tomlBts, &spec); err != nil {
-		return fmt.Errorf("failed to load TOML: %w", err)
+	provenance, err := b.provenance(spec)
+	if err != nil {
+		return err
 	}
 
-	if err := spec.validate(); err != nil {
-		return fmt.Errorf("toml: %w", err)
+	platformNames := slices.Sorted(maps.Keys(spec.Platform))
+
+	manifest, tags, err := b.imageTags(platformNames)
+	if err != nil {
+		return err
 	}
 
-	if len(spec.Platform) > 1 && b.Manifest == "" {
-		return fmt.Errorf("--manifest must be set when building a multiarch image")
+	jobs := b.Jobs
+	if jobs <= 0 || jobs > len(platformNames) {
+		jobs = len(platformNames)
 	}
 
-	if err := os.RemoveAll(TEMP_DIR); err != nil {
-		return fmt.Errorf("failed to remove tmp dir: %w", err)
+	events := globals.events(false, jobs > 1)
+	sf, err := globals.sourceFetcher(events)
+	if err != nil {
+		return err
 	}
-	if err := os.Mkdir(TEMP_DIR, 0755); err != nil {
-		return fmt.Errorf("failed to create tmp dir: %w", err)
+	sf.dir = filepath.Dir(b.Spec)
+
+	// the first error cancels the other builds
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(jobs)
+
+	images := make([]string, len(platformNames))
+	for i, platformName := range platformNames {
+		platformSf := sf.withPlatform(platformName)
+		g.Go(func() error {
+			image, err := b.buildPlatform(gctx, platformSf, spec, platformName, tags[platformName], provenance)
+			if err != nil {
+				return fmt.Errorf("%s: %w", platformName, err)
+			}
+			images[i] = image
+			return nil
+		})
 	}
-	defer os.RemoveAll(TEMP_DIR)
 
-	var images []string
-	for platformName, platform := range spec.Platform {
-		workingPath := removeArchiveExt(filepath.Join(TEMP_DIR, filepath.Base(platform.Labels.SourceURL)))
+	if err := g.Wait(); err != nil {
+		return err
+	}
 
-		fmt.Printf("Downloading %s...\n", platform.Labels.SourceURL)
-		rc, n := downloader(platform.Labels.SourceURL)
-		rc = progress(rc, n, os.Stdout)
-		if platform.Labels.SourceSHA256 != "" {
-			rc = verifier(rc, platform.Labels.SourceSHA256)
-		}
-		rc = decompresser(rc, platform.Labels.SourceURL)
-		if err := save(rc, workingPath+".part"); err != nil {
-			return fmt.Errorf("%s: %w", platform.Labels.SourceURL, err)
+	var reference string
+	if len(spec.Platform) == 1 {
+		reference = images[0]
+	} else {
+		// tag the manifest list with all tags, whichever it is named by
+		var manifestTags []string
+		for _, tag := range b.Tag {
+			if tag != manifest {
+				manifestTags = append(manifestTags, tag)
+			}
 		}
 
-		if err := os.Rename(workingPath+".part", workingPath); err != nil {
-			return fmt.Errorf("failed to rename: %w", err)
+		events.Start(event.PhaseManifest, "Creating manifest %s...", manifest)
+		if reference, err = podman.CreateManifest(manifest, images, podman.WithTags(manifestTags...)); err != nil {
+			return fmt.Errorf("failed to create manifest: %w", err)
 		}
+		events.End(event.PhaseManifest)
+	}
 
-		name := b.Tag
-		if len(spec.Platform) > 1 && name != "" {
-			name += "-" + platformName
-			name = strings.ReplaceAll(name, ":", "-")
-			name = strings.ReplaceAll(name, "/", "-")
-		}
+	events.Result(event.Result{Reference: reference, Images: images})
+	return nil
+}
 
-		if name == "" {
-			fmt.Printf("Importing...\n")
-		} else {
-			fmt.Printf("Importing %s...\n", name)
-		}
-		readCloser := guestfish.TarOut(workingPath, "/dev/"+platform.Labels.GetSourcePartitionsImport())
+// imageTags returns the manifest list of a multi-platform build and the tags
+// of the image of every platform.
+func (b *ContainerBuildCmd) imageTags(platformNames []string) (string, map[string][]string, error) {
+	if len(platformNames) == 1 {
+		return b.Manifest, map[string][]string{platformNames[0]: b.Tag}, nil
+	}
 
-		importOpts := []podman.ImportOption{
-			podman.WithPlatform(platformName),
-			podman.WithLabels(spec.Labels),
-			podman.WithLabelsToml(platform.Labels),
+	manifest := b.Manifest
+	if manifest == "" {
+		if len(b.Tag) == 0 {
+			return "", nil, fmt.Errorf("--manifest or --tag must be set when building a multiarch image")
 		}
+		manifest = b.Tag[0]
+	}
 
-		if name != "" {
-			importOpts = append(importOpts, podman.WithName(name))
-		}
+	tags, err := platformTags(b.PlatformTagTemplate, b.Tag, platformNames)
+	if err != nil {
+		return "", nil, err
+	}
+	return manifest, tags, nil
+}
+
+// provenance returns the labels recording how the images are built, those of
+// the source images aside. The spec is hashed as rendered, so that changes to
+// the specs it extends and to --set variables change the hash too.
+func (b *ContainerBuildCmd) provenance(spec *Spec) (map[string]string, error) {
+	specData, err := spec.render()
+	if err != nil {
+		return nil, err
+	}
+	specSum := sha256.Sum256(specData)
+
+	created, err := buildTime()
+	if err != nil {
+		return nil, err
+	}
+
+	labels := map[string]string{
+		labelBuildVersion:    pipodVersion(),
+		labelBuildSpecSHA256: hex.EncodeToString(specSum[:]),
+		labelOCICreated:      created.Format(time.RFC3339),
+	}
 
-		img, err := podman.Import(readCloser, importOpts...)
+	if spec.Disk != nil {
+		layout, err := spec.Disk.layout()
 		if err != nil {
-			return fmt.Errorf("failed to import podman image: %w", err)
+			return nil, fmt.Errorf("disk: %w", err)
 		}
+		layoutJSON, err := json.Marshal(layout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal disk layout: %w", err)
+		}
+		labels[labelDiskLayout] = string(layoutJSON)
+	}
+
+	return labels, nil
+}
 
-		images = append(images, img.Name)
+// buildPlatform downloads the source image of a platform and imports it as a
+// container image.
+func (b *ContainerBuildCmd) buildPlatform(ctx context.Context, sf *sourceFetcher, spec *Spec, platformName string, tags []string, provenance map[string]string) (string, error) {
+	platform := spec.Platform[platformName]
+
+	mounts, err := platform.pipod.GetSourcePartitionsImport()
+	if err != nil {
+		return "", err
 	}
 
-	var reference string
-	if len(spec.Platform) == 1 {
-		reference = images[0]
+	entry, err := sf.fetch(ctx, platform.pipod, false)
+	if err != nil {
+		return "", err
+	}
+	defer entry.Unlock()
+
+	var name string
+	if len(tags) > 0 {
+		name = tags[0]
+	}
+
+	if name == "" {
+		sf.events.Start(event.PhaseImport, "Importing...")
 	} else {
-		fmt.Printf("Creating manifest %s...\n", b.Manifest)
-		if reference, err = podman.CreateManifest(b.Manifest, images); err != nil {
-			return fmt.Errorf("failed to create manifest: %w", err)
-		}
+		sf.events.Start(event.PhaseImport, "Importing %s...", name)
+	}
+	layout, err := readImageLayout(entry.ImagePath())
+	if err != nil {
+		return "", fmt.Errorf("failed to read partition layout: %w", err)
 	}
 
-	fmt.Println("Build complete.")
-	fmt.Println(reference)
-	return nil
+	layoutJSON, err := json.Marshal(layout)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal partition layout: %w", err)
+	}
+
+	devices, err := mounts.resolve(layout.Partitions)
+	if err != nil {
+		return "", fmt.Errorf("failed to select partitions: %w", err)
+	}
+
+	readCloser := guestfish.TarOut(ctx, entry.ImagePath(), devices)
+	readCloser = progress(readCloser, sf.events.Progress(event.PhaseImport, 0))
+
+	importOpts := []podman.ImportOption{
+		podman.WithPlatform(platformName),
+		// the spec may set org.opencontainers.image.created itself
+		podman.WithLabels(provenance),
+		podman.WithLabels(map[string]string{
+			labelSourceDownloadSHA256: entry.Meta.SHA256,
+			labelSourceImageSize:      strconv.FormatInt(entry.Meta.ImageSize, 10),
+			labelSourceDiskLayout:     string(layoutJSON),
+		}),
+		podman.WithLabels(spec.Labels),
+		podman.WithLabels(platform.resolvedLabels(sf.dir)),
+		// record the mapping even if the default, so that disk build and
+		// sync route files to the same partitions
+		podman.WithLabels(map[string]string{labelSourcePartitionsImport: mounts.String()}),
+	}
+
+	if name != "" {
+		importOpts = append(importOpts, podman.WithName(name), podman.WithTags(tags[1:]...))
+	}
+
+	img, err := podman.Import(ctx, readCloser, importOpts...)
+	readCloser.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to import podman image: %w", err)
+	}
+
+	return img.Name, nil
 }
 
 type DiskCmd struct {
 	Build DiskBuildCmd `cmd:"" help:"Build a disk image from a Containerfile"`
 	Wifi  DiskWifiCmd  `cmd:"" help:"Setup a wifi connection"`
+	Flash DiskFlashCmd `cmd:"" help:"Write a disk image to a device"`
 }
 
 type DiskBuildCmd struct {
-	Out           string `short:"o" help:"File to write to" default:"build/out.img"`
-	Platform      string `default:"linux/arm64" help:"Set the OS/ARCH[/VARIANT] of the image"`
-	ForceDownload bool   `help:"Force download even if the output file exists"`
-	Verbose       bool   `short:"v" help:"Print paths of all synced files"`
+	Out                 string `short:"o" help:"File to write to. Compressed if it ends in e.g. .xz, .zst, .gz or .bz2, with its sha256 hash written next to it" default:"build/out.img"`
+	Platform            string `help:"Set the OS/ARCH[/VARIANT] of the image (default: the platform of the base image if it has only one, or linux/arm64)"`
+	FromScratch         bool   `help:"Create the disk image from the partition layout recorded in the container image labels instead of copying the source image"`
+	Size                string `help:"Size of the disk image, e.g. 8G, or how much to add to the size of the source image, e.g. +2G. The last partition and its filesystem grow to fill it (default: grown to fit the container image if needed)"`
+	ForceDownload       bool   `help:"Force download even if the source image is cached"`
+	Shrink              bool   `help:"Shrink the root filesystem, its partition and the disk image to the space used plus --shrink-headroom. The root filesystem grows to fill the disk on first boot"`
+	ShrinkHeadroom      string `default:"256M" help:"Free space to leave in the root filesystem of a shrunk disk image"`
+	Bmap                bool   `help:"Write a bmaptool block map of the disk image next to it, e.g. build/out.img.bmap, so that flashing can skip empty blocks"`
+	AllowSourceMismatch bool   `help:"Only warn if the source image differs from the one the container image was built from"`
+	AllowLayoutMismatch bool   `help:"Only warn if the partition layout of the source image differs from the one the container image was built from"`
+	Verbose             bool   `short:"v" help:"Print paths of all synced files"`
 }
 
-const (
-	green          = "\033[32m"
-	reset          = "\033[0m"
-	cursorUp       = "\033[%dA"
-	eraseInDisplay = "\033[J"
-)
+func (b *DiskBuildCmd) Run(ctx context.Context, globals *Globals) error {
+	events := globals.events(b.Verbose, false)
 
-var aferoSyncStdout = iio.Writer(os.Stdout.Write).WithPrefix(green + "[aferosync]" + reset)
+	headroom, err := parseSize(b.ShrinkHeadroom)
+	if err != nil {
+		return fmt.Errorf("--shrink-headroom: %w", err)
+	}
 
-func (b *DiskBuildCmd) Run(kctx *kong.Context) error {
-	fmt.Printf("Building . for platform %s...\n", b.Platform)
-	image, err := podman.Build(b.Platform)
+	platform, err := b.platform(events)
+	if err != nil {
+		return err
+	}
+
+	events.Start(event.PhaseBuild, "Building . for platform %s...", platform)
+	image, err := podman.Build(platform.String())
 	if err != nil {
 		return fmt.Errorf("failed to build podman image: %w", err)
 	}
+	events.End(event.PhaseBuild)
 
 	var labels PipodLabels
 	if err := image.UnmarshalLabelsToml(&labels); err != nil {
@@ -164,74 +297,386 @@ func (b *DiskBuildCmd) Run(kctx *kong.Context) error {
 		return fmt.Errorf("labels validation failed: %w", err)
 	}
 
+	mounts, err := labels.GetSourcePartitionsImport()
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(b.Out), 0755); err != nil {
+		return fmt.Errorf("failed to make build dir: %w", err)
+	}
+
+	// a compressed disk image is built uncompressed first
 	outPart := b.Out + ".part"
-	if _, err := os.Stat(b.Out); err == nil && !b.ForceDownload {
-		fmt.Printf("Skipping the download step: %s already exists (rerun with --force-download to download anyway)\n", b.Out)
-		if err := os.Rename(b.Out, outPart); err != nil {
-			return fmt.Errorf("failed to rename %s to %s: %w", b.Out, outPart, err)
+	imagePart := outPart
+	comp := compression(b.Out)
+	if comp != nil {
+		imagePart = removeArchiveExt(b.Out) + ".part"
+	}
+
+	if b.FromScratch {
+		err = b.createImage(events, labels, imagePart)
+	} else {
+		err = b.copySourceImage(ctx, globals, events, labels, imagePart)
+	}
+	if err != nil {
+		return err
+	}
+
+	fsys, err := openPartitionsFs(imagePart, mounts)
+	if err != nil {
+		return fmt.Errorf("failed to open partitions: %w", err)
+	}
+
+	// a disk image created from scratch has the layout it was created with,
+	// but only the partitions imported into the container image get files
+	if b.FromScratch {
+		for _, p := range emptyPartitions(fsys.layout, fsys.mounts) {
+			events.Info("Warning: partition %s (%s) is created empty, as %s doesn't import it", p.Device, cmp.Or(p.Label, p.FSType), labelSourcePartitionsImport)
 		}
 	} else {
-		if err = os.MkdirAll(filepath.Dir(b.Out), 0755); err != nil {
-			return fmt.Errorf("failed to make build dir: %w", err)
+		if err := b.checkLayout(events, labels, fsys.layout); err != nil {
+			fsys.Close()
+			return err
+		}
+	}
+
+	growth, err := b.growth(image, fsys)
+	if err != nil {
+		fsys.Close()
+		return err
+	}
+
+	if growth > 0 {
+		if err := fsys.Close(); err != nil {
+			return fmt.Errorf("failed to close partitions: %w", err)
 		}
 
-		fmt.Printf("Downloading %s...\n", labels.SourceURL)
-		rc, n := downloader(labels.SourceURL)
-		rc = progress(rc, n, os.Stdout)
-		if labels.SourceSHA256 != "" {
-			rc = verifier(rc, labels.SourceSHA256)
+		events.Start(event.PhaseGrow, "Growing %s by %s...", imagePart, event.ByteCountIEC(growth))
+		if err := growDiskImage(imagePart, fsys.layout.Size+growth); err != nil {
+			return fmt.Errorf("failed to grow disk image: %w", err)
 		}
-		rc = decompresser(rc, labels.SourceURL)
-		if err := save(rc, outPart); err != nil {
-			return fmt.Errorf("failed to download %s: %w", labels.SourceURL, err)
+		events.End(event.PhaseGrow)
+
+		if fsys, err = openPartitionsFs(imagePart, mounts); err != nil {
+			return fmt.Errorf("failed to open partitions: %w", err)
 		}
 	}
 
-	fmt.Printf("Syncing with %s...\n", outPart)
+	events.Start(event.PhaseSync, "Syncing with %s...", imagePart)
 	reader, err := image.TarOut()
 	if err != nil {
+		fsys.Close()
 		return fmt.Errorf("failed to tar podman image: %w", err)
 	}
 	defer reader.Close()
 
-	fsys, err := aferoguestfs.OpenPartitionFs(outPart, "/dev/"+labels.GetSourcePartitionsImport())
-	if err != nil {
-		return fmt.Errorf("failed to open partition: %w", err)
+	if err := syncFiles(events, fsys, tar.NewReader(reader)); err != nil {
+		fsys.Close()
+		return fmt.Errorf("failed to sync: %w", err)
 	}
 
-	if b.Verbose {
-		err = aferoSyncVerbose(fsys, tar.NewReader(reader), aferoSyncStdout)
-	} else {
-		err = aferoSyncCompact(fsys, tar.NewReader(reader), aferoSyncStdout)
+	if b.Shrink {
+		// the root filesystem grows back to fill the disk on first boot
+		if added, err := growfs.Install(fsys); err != nil {
+			events.Info("Warning: the root filesystem won't grow on first boot: %s", err)
+		} else {
+			for _, path := range added {
+				events.Info("added %s", path)
+			}
+		}
 	}
-	if err != nil {
-		return fmt.Errorf("failed to sync: %w", err)
+
+	if err := fsys.Close(); err != nil {
+		return fmt.Errorf("failed to close partitions: %w", err)
+	}
+
+	if b.Shrink {
+		events.Start(event.PhaseShrink, "Shrinking %s...", imagePart)
+		size, err := shrinkDiskImage(imagePart, fsys.root(), headroom)
+		if err != nil {
+			return fmt.Errorf("failed to shrink disk image: %w", err)
+		}
+		events.End(event.PhaseShrink)
+		events.Info("Shrunk %s from %s to %s", imagePart, event.ByteCountIEC(fsys.layout.Size), event.ByteCountIEC(size))
+	}
+
+	// the block map is of the uncompressed disk image
+	var bm []byte
+	if b.Bmap {
+		events.Start(event.PhaseBmap, "Mapping blocks of %s...", imagePart)
+		if bm, err = createBmap(imagePart); err != nil {
+			return fmt.Errorf("failed to create bmap: %w", err)
+		}
+		events.End(event.PhaseBmap)
+	}
+
+	var sum string
+	if comp != nil {
+		// the progress of compressing ends the phase
+		events.Start(event.PhaseCompress, "Compressing %s to %s...", imagePart, outPart)
+		sum, err = compressFile(ctx, events, comp, imagePart, outPart)
+		if err != nil {
+			return fmt.Errorf("failed to compress disk image: %w", err)
+		}
+		if err := os.Remove(imagePart); err != nil {
+			return fmt.Errorf("failed to remove uncompressed disk image: %w", err)
+		}
 	}
 
+	events.Start(event.PhaseRename, "Renaming %s to %s...", outPart, b.Out)
 	if err := os.Rename(outPart, b.Out); err != nil {
 		return fmt.Errorf("failed to rename: %w", err)
 	}
+	events.End(event.PhaseRename)
 
-	fmt.Println("Build complete.")
-	fmt.Println(b.Out)
+	if comp != nil {
+		if err := writeSHA256File(b.Out, sum); err != nil {
+			return err
+		}
+		events.Info("Wrote %s.sha256", b.Out)
+	}
+
+	if b.Bmap {
+		if err := os.WriteFile(bmapPath(b.Out), bm, 0644); err != nil {
+			return fmt.Errorf("failed to write bmap: %w", err)
+		}
+		events.Info("Wrote %s", bmapPath(b.Out))
+	}
+
+	events.Result(event.Result{Disk: b.Out})
 
 	return nil
 }
 
+// copySourceImage downloads the source image of the container image and
+// copies it to image.
+func (b *DiskBuildCmd) copySourceImage(ctx context.Context, globals *Globals, events *event.Emitter, labels PipodLabels, image string) error {
+	sf, err := globals.sourceFetcher(events)
+	if err != nil {
+		return err
+	}
+
+	entry, err := sf.fetch(ctx, labels, b.ForceDownload)
+	if err != nil {
+		return err
+	}
+	defer entry.Unlock()
+
+	if labels.SourceDownloadSHA256 != "" && !strings.EqualFold(entry.Meta.SHA256, labels.SourceDownloadSHA256) {
+		msg := fmt.Sprintf("source image %s has sha256 %s, but the container image was built from one with sha256 %s", labels.SourceURL, entry.Meta.SHA256, labels.SourceDownloadSHA256)
+		if !b.AllowSourceMismatch {
+			return fmt.Errorf("%s, pass --allow-source-mismatch to build anyway", msg)
+		}
+		events.Info("Warning: %s", msg)
+	}
+
+	events.Start(event.PhaseCopy, "Copying source image to %s...", image)
+	if err := entry.CloneImage(image); err != nil {
+		return fmt.Errorf("failed to copy source image: %w", err)
+	}
+	events.End(event.PhaseCopy)
+
+	return nil
+}
+
+// createImage creates image with the partition layout of the [disk] section
+// of the build spec of the container image, or else of its source image.
+func (b *DiskBuildCmd) createImage(events *event.Emitter, labels PipodLabels, image string) error {
+	layout, size, err := b.createLayout(labels)
+	if err != nil {
+		return err
+	}
+
+	events.Start(event.PhaseCreate, "Creating %s disk image %s...", event.ByteCountIEC(size), image)
+	if err := createDiskImage(image, layout, size); err != nil {
+		return fmt.Errorf("failed to create disk image: %w", err)
+	}
+	events.End(event.PhaseCreate)
+
+	return nil
+}
+
+// createLayout returns the partition layout and the size of the disk image to
+// create. With --size, the last partition fills the disk.
+func (b *DiskBuildCmd) createLayout(labels PipodLabels) (*diskLayout, int64, error) {
+	label, layoutJSON := labelDiskLayout, labels.DiskLayout
+	if layoutJSON == "" {
+		label, layoutJSON = labelSourceDiskLayout, labels.SourceDiskLayout
+	}
+	if layoutJSON == "" {
+		return nil, 0, fmt.Errorf("the container image has no partition layout, rebuild it with this version of pipod or add a [disk] section to its build spec")
+	}
+
+	var layout diskLayout
+	if err := json.Unmarshal([]byte(layoutJSON), &layout); err != nil {
+		return nil, 0, fmt.Errorf("invalid %s label: %w", label, err)
+	}
+	if layout.Table == "" {
+		return nil, 0, fmt.Errorf("the source image has no partition table to create, add a [disk] section to the build spec of the container image")
+	}
+
+	size := layout.Size
+	if b.Size != "" {
+		var err error
+		if size, err = parseDiskSize(b.Size, layout.Size); err != nil {
+			return nil, 0, fmt.Errorf("--size: %w", err)
+		}
+		size = alignUp(size, sectorSize)
+
+		// the partitions of a source image layout all have a size
+		if n := len(layout.Partitions); n > 0 {
+			layout.Partitions[n-1].Size = 0
+		}
+	}
+	if size == 0 {
+		return nil, 0, fmt.Errorf("the partition layout has no disk size, pass --size to set it")
+	}
+
+	return &layout, size, nil
+}
+
+// growth returns how much to grow the disk image of fsys by: up to --size, or
+// else as much as the root filesystem needs to fit the container image.
+func (b *DiskBuildCmd) growth(image *podman.Image, fsys *partitionsFs) (int64, error) {
+	size := fsys.layout.Size
+	if b.Size != "" {
+		// created at --size, with the last partition filling it
+		if b.FromScratch {
+			return 0, nil
+		}
+
+		target, err := parseDiskSize(b.Size, size)
+		if err != nil {
+			return 0, fmt.Errorf("--size: %w", err)
+		}
+		target = alignUp(target, sectorSize)
+		if target < size {
+			return 0, fmt.Errorf("--size %s is smaller than the source image, which is %s", b.Size, event.ByteCountIEC(size))
+		}
+		return target - size, nil
+	}
+
+	imageSize, err := image.Size()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get size of container image: %w", err)
+	}
+	// filesystems take more space than the files they hold
+	need := imageSize + imageSize/10
+
+	st, err := fsys.inner.Statvfs("/")
+	if err != nil {
+		return 0, fmt.Errorf("statvfs failed: %w", err)
+	}
+	// all but the blocks reserved for root, as the files are replaced
+	capacity := (st.Blocks - (st.Bfree - st.Bavail)) * st.Frsize
+	if need <= capacity {
+		return 0, nil
+	}
+
+	if len(fsys.layout.Partitions) == 0 {
+		return 0, fmt.Errorf("the container image needs %s, but the root filesystem only holds %s and can't grow as the disk image has no partition table", event.ByteCountIEC(need), event.ByteCountIEC(capacity))
+	}
+	if last := fsys.layout.Partitions[len(fsys.layout.Partitions)-1]; fsys.root() != last.Device {
+		return 0, fmt.Errorf("the container image needs %s, but the root filesystem on %s only holds %s and can't grow as it isn't the last partition", event.ByteCountIEC(need), fsys.root(), event.ByteCountIEC(capacity))
+	}
+
+	return alignUp(need-capacity, partitionAlign), nil
+}
+
+// defaultDiskPlatform is the platform disk images are built for if neither
+// --platform nor the base image tell.
+const defaultDiskPlatform = "linux/arm64"
+
+// platform returns the platform to build for. It checks that the base image
+// of the Containerfile has it, and picks the platform of the base image if it
+// has only one and none is requested.
+func (b *DiskBuildCmd) platform(events *event.Emitter) (platform.Platform, error) {
+	var requested platform.Platform
+	if b.Platform != "" {
+		p, err := platform.Parse(b.Platform)
+		if err != nil {
+			return platform.Platform{}, err
+		}
+		requested = p
+	}
+
+	base, err := baseImage(".")
+	if err != nil {
+		return platform.Platform{}, err
+	}
+
+	var available []platform.Platform
+	if base != "" {
+		available, err = podman.Platforms(base)
+		if err != nil {
+			events.Info("Warning: failed to read the platforms of base image %s: %s", base, err)
+		}
+	}
+
+	switch {
+	case b.Platform != "" && len(available) > 0 && !slices.Contains(available, requested):
+		return platform.Platform{}, fmt.Errorf("base image %s has no platform %s, only %s", base, requested, platform.Join(available))
+	case b.Platform != "":
+		return requested, nil
+	case len(available) == 1:
+		return available[0], nil
+	case len(available) > 1:
+		return platform.Platform{}, fmt.Errorf("base image %s has platforms %s, pass --platform to choose one", base, platform.Join(available))
+	default:
+		return platform.Parse(defaultDiskPlatform)
+	}
+}
+
+// checkLayout checks that the partition layout of the disk image is the one
+// the container image was built from.
+func (b *DiskBuildCmd) checkLayout(events *event.Emitter, labels PipodLabels, layout *diskLayout) error {
+	if labels.SourceDiskLayout == "" {
+		return nil
+	}
+
+	var want diskLayout
+	if err := json.Unmarshal([]byte(labels.SourceDiskLayout), &want); err != nil {
+		return fmt.Errorf("invalid %s label: %w", labelSourceDiskLayout, err)
+	}
+
+	diffs := want.diff(layout)
+	if len(diffs) == 0 {
+		return nil
+	}
+
+	msg := fmt.Sprintf("the partition layout of the source image differs from the one the container image was built from: %s", strings.Join(diffs, ", "))
+	if !b.AllowLayoutMismatch {
+		return fmt.Errorf("%s, pass --allow-layout-mismatch to build anyway", msg)
+	}
+	events.Info("Warning: %s", msg)
+	return nil
+}
+
 type SyncCmd struct {
 	DestDisk          string   `required:"" help:"Path to the destination disk image"`
 	SrcTar            *os.File `xor:"src" required:"" existingfile:"" help:"Path to the source tar archive (use --tar-src=- to read from stdin, cannot be used with --src-container-image or --disk-src)"`
 	SrcContainerImage string   `xor:"src" required:"" help:"Name of the source container image (cannot be used with --src-tar or --src-disk)"`
 	SrcDisk           string   `xor:"src" required:"" help:"Path to the source disk image (cannot be used with --src-tar --src-container-image)"`
-	Partition         string   `default:"sda2" help:"Partition device (default: sda2)"`
+	Partition         string   `help:"Partitions to sync as comma separated partition:mountpoint pairs, e.g. sda2:/,label=bootfs:/boot/firmware (default: the partitions the source container image was imported from, or sda2)"`
 	Verbose           bool     `short:"v" help:"Print paths of all synced files"`
 	IgnoreErrors      bool     `help:"Skip files that fail to sync"`
 }
 
-func (cmd *SyncCmd) Run() error {
-	afs, err := aferoguestfs.OpenPartitionFs(cmd.DestDisk, "/dev/"+cmd.Partition)
+func (cmd *SyncCmd) Run(globals *Globals) error {
+	events := globals.events(cmd.Verbose, false)
+
+	labels := PipodLabels{SourcePartitionsImport: cmd.Partition}
+	if cmd.Partition == "" && cmd.SrcContainerImage != "" {
+		image := podman.Image{Name: cmd.SrcContainerImage}
+		if err := image.UnmarshalLabelsToml(&labels); err != nil {
+			return fmt.Errorf("failed to get image labels: %w", err)
+		}
+	}
+
+	mounts, err := labels.GetSourcePartitionsImport()
 	if err != nil {
-		return fmt.Errorf("failed to open partition: %w", err)
+		return err
 	}
 
 	var tarReader *tar.Reader
@@ -246,7 +691,11 @@ func (cmd *SyncCmd) Run() error {
 		defer rc.Close()
 		tarReader = tar.NewReader(rc)
 	} else if cmd.SrcDisk != "" {
-		rc := guestfish.TarOut(cmd.SrcDisk, "/dev/"+cmd.Partition)
+		devices, err := mounts.resolveImage(cmd.SrcDisk)
+		if err != nil {
+			return fmt.Errorf("failed to select partitions of %s: %w", cmd.SrcDisk, err)
+		}
+		rc := guestfish.TarOut(context.Background(), cmd.SrcDisk, devices)
 		defer rc.Close()
 		tarReader = tar.NewReader(rc)
 	}
@@ -256,28 +705,41 @@ func (cmd *SyncCmd) Run() error {
 		opts = append(opts, aferosync.WithIgnoreErrors(true))
 	}
 
-	if cmd.Verbose {
-		err = aferoSyncVerbose(afs, tarReader, os.Stdout, opts...)
-	} else {
-		err = aferoSyncCompact(afs, tarReader, os.Stdout, opts...)
-	}
+	afs, err := openPartitionsFs(cmd.DestDisk, mounts)
 	if err != nil {
+		return fmt.Errorf("failed to open partitions: %w", err)
+	}
+
+	events.Start(event.PhaseSync, "Syncing with %s...", cmd.DestDisk)
+	if err := syncFiles(events, afs, tarReader, opts...); err != nil {
+		afs.Close()
 		return fmt.Errorf("failed to sync: %w", err)
 	}
 
+	if err := afs.Close(); err != nil {
+		return fmt.Errorf("failed to close partitions: %w", err)
+	}
+
 	return nil
 }
 
 type DiskWifiCmd struct {
 	Disk          string `arg:"" help:"Path to disk image"`
-	Partition     string `default:"sda2" help:"Partition device (default: sda2)"`
+	Partition     string `default:"sda2" help:"Partition device or selector: label=, uuid=, partuuid=, fstype= or largest (default: sda2)"`
 	SSID          string `required:"" help:"SSID fot wifi network to connect to"`
 	Password      string `xor:"P" required:"" help:"Password of the SSID network (cannot be used with --password-stdin)"`
 	PasswordStdin bool   `xor:"P" required:"" help:"Read password from stdin (cannot be used with --password)"`
 }
 
-func (cmd *DiskWifiCmd) Run() error {
-	afs, err := aferoguestfs.OpenPartitionFs(cmd.Disk, "/dev/"+cmd.Partition)
+func (cmd *DiskWifiCmd) Run(globals *Globals) error {
+	events := globals.events(false, false)
+
+	mounts, err := parsePartitionMounts(cmd.Partition)
+	if err != nil {
+		return err
+	}
+
+	afs, err := openPartitionsFs(cmd.Disk, mounts)
 	if err != nil {
 		return fmt.Errorf("failed to open partition: %w", err)
 	}
@@ -297,7 +759,7 @@ func (cmd *DiskWifiCmd) Run() error {
 	} else if err != nil {
 		return fmt.Errorf("failed to create NetworkManager: %w", err)
 	}
-	fmt.Println("NetworkManager detected")
+	events.Info("NetworkManager detected")
 
 	addedPaths, err := nm.AddConnection(cmd.SSID, cmd.Password)
 	if err != nil {
@@ -305,59 +767,136 @@ func (cmd *DiskWifiCmd) Run() error {
 	}
 
 	for _, path := range addedPaths {
-		fmt.Printf("added %s\n", path)
+		events.Info("added %s", path)
 	}
 
 	return nil
 }
 
-func aferoSyncVerbose(afs afero.Fs, tarReader *tar.Reader, w io.Writer, opts ...aferosync.Option) error {
-	sync := aferosync.New(afs, tarReader, opts...)
-	for sync.Next() {
-		fmt.Fprintln(w, sync.Update())
+type DiskFlashCmd struct {
+	Image  string `arg:"" type:"existingfile" help:"Disk image to write, compressed or not"`
+	Device string `arg:"" help:"Device to write to, e.g. /dev/sdb"`
+	Bmap   bool   `help:"Only write the blocks listed in the bmap file next to the image, e.g. out.img.bmap for out.img.xz, and verify their checksums"`
+}
+
+func (cmd *DiskFlashCmd) Run(ctx context.Context, globals *Globals) error {
+	events := globals.events(false, false)
+
+	if err := checkUnmounted(cmd.Device); err != nil {
+		return err
 	}
-	fmt.Fprintln(w, sync.Summary())
-	return sync.Err()
+
+	var bm *bmap.Bmap
+	if cmd.Bmap {
+		var err error
+		if bm, err = findBmap(cmd.Image); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(cmd.Image)
+	if err != nil {
+		return fmt.Errorf("failed to open image: %w", err)
+	}
+	defer f.Close()
+
+	var rc io.ReadCloser = io.NopCloser(iio.ContextReader(ctx, f))
+	size := int64(0)
+	if comp := compression(cmd.Image); comp != nil {
+		if rc, err = comp.OpenReader(rc); err != nil {
+			return fmt.Errorf("failed to open decompressor: %w", err)
+		}
+	} else if st, err := f.Stat(); err == nil {
+		size = st.Size()
+	}
+	if bm != nil {
+		size = bm.ImageSize
+	}
+
+	dev, st, err := openDevice(cmd.Device)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	if st.Mode()&os.ModeDevice != 0 && size > 0 {
+		devSize, err := dev.Seek(0, io.SeekEnd)
+		if err != nil {
+			return fmt.Errorf("failed to get device size: %w", err)
+		}
+		if devSize < size {
+			return fmt.Errorf("%s is %s, too small for the %s image", cmd.Device, event.ByteCountIEC(devSize), event.ByteCountIEC(size))
+		}
+		if _, err := dev.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek device: %w", err)
+		}
+	}
+
+	events.Start(event.PhaseFlash, "Writing %s to %s...", cmd.Image, cmd.Device)
+	rc = progress(rc, events.Progress(event.PhaseFlash, size))
+	defer rc.Close()
+
+	if bm != nil {
+		err = bm.Copy(dev, rc)
+		// skipped blocks at the end of a file are left out otherwise
+		if err == nil && st.Mode().IsRegular() {
+			err = dev.Truncate(bm.ImageSize)
+		}
+	} else {
+		_, err = io.Copy(dev, rc)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write image: %w", err)
+	}
+
+	// flushed writes are part of the phase, which closing its progress ends
+	if err := dev.Sync(); err != nil {
+		return fmt.Errorf("failed to sync device: %w", err)
+	}
+	if err := dev.Close(); err != nil {
+		return fmt.Errorf("failed to close device: %w", err)
+	}
+	rc.Close()
+
+	if bm != nil {
+		events.Info("Wrote %s of %s mapped by the bmap", event.ByteCountIEC(bm.MappedSize()), event.ByteCountIEC(bm.ImageSize))
+	}
+
+	return nil
 }
 
-func aferoSyncCompact(afs afero.Fs, tarReader *tar.Reader, w io.Writer, opts ...aferosync.Option) error {
+// syncFiles syncs afs with the files of tarReader and emits every update.
+func syncFiles(events *event.Emitter, afs afero.Fs, tarReader *tar.Reader, opts ...aferosync.Option) error {
 	sync := aferosync.New(afs, tarReader, opts...)
-	firstUpdate := true
-	fmt.Fprint(w, sync.Summary())
 	for sync.Next() {
-		if firstUpdate {
-			fmt.Fprint(w, "\r"+eraseInDisplay)
-		} else {
-			fmt.Fprintf(w, cursorUp+"\r"+eraseInDisplay, 1)
-		}
-		fmt.Fprintln(w, sync.Update())
-		fmt.Fprint(w, sync.Summary())
-		firstUpdate = false
+		upd := sync.Update()
+		events.File(syncFile(upd), upd.String(), syncSummary(sync.Summary()))
 	}
-	fmt.Fprintln(w)
+	events.EndSync(syncSummary(sync.Summary()))
 	return sync.Err()
 }
 
-func removeArchiveExt(name string) string {
-	decompressors := []archives.Format{
-		archives.Brotli{},
-		archives.Bz2{},
-		archives.Gz{},
-		archives.Lz4{},
-		archives.Lzip{},
-		archives.MinLZ{},
-		archives.Sz{},
-		archives.Xz{},
-		archives.Zlib{},
-		archives.Zstd{},
+func syncFile(upd aferosync.PathUpdate) event.File {
+	f := event.File{Path: upd.Path}
+	switch {
+	case upd.Added:
+		f.Action = "added"
+	case upd.Deleted:
+		f.Action = "deleted"
+	case upd.Error != nil:
+		f.Action = "error"
+		f.Error = upd.Error.Error()
+	default:
+		f.Action = "updated"
 	}
+	return f
+}
 
-	ext := filepath.Ext(name)
-	for _, d := range decompressors {
-		if ext == d.Extension() {
-			return name[:len(name)-len(ext)]
-		}
+func syncSummary(s aferosync.Summary) event.Summary {
+	return event.Summary{
+		Added:   s.Added,
+		Updated: s.Updated,
+		Deleted: s.Deleted,
+		Errors:  s.Errors,
 	}
-
-	return name
 }
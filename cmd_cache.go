@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gaboose/pipod/internal/cache"
+	"github.com/gaboose/pipod/internal/event"
+)
+
+type CacheCmd struct {
+	Ls     CacheLsCmd     `cmd:"" help:"List cached source images"`
+	Prune  CachePruneCmd  `cmd:"" help:"Remove cached source images"`
+	Verify CacheVerifyCmd `cmd:"" help:"Verify cached source images against their checksums"`
+}
+
+type CacheLsCmd struct{}
+
+func (cmd *CacheLsCmd) Run(globals *Globals) error {
+	c, err := globals.cache()
+	if err != nil {
+		return err
+	}
+
+	entries, err := c.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tSIZE\tLAST USED\tURL")
+	for _, e := range entries {
+		size, err := e.Size()
+		if err != nil {
+			return fmt.Errorf("failed to get size of %s: %w", e.Key, err)
+		}
+
+		lastUsed := "incomplete"
+		if e.Complete() {
+			lastUsed = e.Meta.LastUsed.Format(time.DateTime)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", shortKey(e.Key), event.ByteCountIEC(size), lastUsed, e.Meta.URL)
+	}
+
+	return w.Flush()
+}
+
+type CachePruneCmd struct {
+	All       bool          `help:"Remove all entries"`
+	UnusedFor time.Duration `default:"720h" help:"Remove entries that have not been used for this long"`
+}
+
+func (cmd *CachePruneCmd) Run(globals *Globals) error {
+	c, err := globals.cache()
+	if err != nil {
+		return err
+	}
+
+	entries, err := c.List()
+	if err != nil {
+		return err
+	}
+
+	var reclaimed int64
+	for _, e := range entries {
+		if !cmd.prune(e) {
+			continue
+		}
+
+		// entries in use by builds are left alone
+		if locked, err := e.TryLock(); err != nil {
+			return err
+		} else if !locked {
+			fmt.Printf("skipped %s %s, in use\n", shortKey(e.Key), e.Meta.URL)
+			continue
+		} else if !cmd.prune(e) {
+			// used since it was listed
+			e.Unlock()
+			continue
+		}
+
+		size, err := e.Size()
+		if err != nil {
+			e.Unlock()
+			return fmt.Errorf("failed to get size of %s: %w", e.Key, err)
+		}
+
+		err = e.Remove()
+		e.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to remove %s: %w", e.Key, err)
+		}
+
+		fmt.Printf("removed %s %s\n", shortKey(e.Key), e.Meta.URL)
+		reclaimed += size
+	}
+
+	fmt.Printf("Reclaimed %s\n", event.ByteCountIEC(reclaimed))
+	return nil
+}
+
+// prune reports whether e is to be removed.
+func (cmd *CachePruneCmd) prune(e *cache.Entry) bool {
+	return cmd.All || !e.Complete() || time.Since(e.Meta.LastUsed) >= cmd.UnusedFor
+}
+
+type CacheVerifyCmd struct {
+	Remove bool `help:"Remove entries that fail verification"`
+}
+
+func (cmd *CacheVerifyCmd) Run(globals *Globals) error {
+	c, err := globals.cache()
+	if err != nil {
+		return err
+	}
+
+	entries, err := c.List()
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for _, e := range entries {
+		ok, err := cmd.verify(e)
+		if err != nil {
+			return err
+		} else if !ok {
+			failed++
+		}
+	}
+
+	if failed > 0 && !cmd.Remove {
+		return fmt.Errorf("%d of %d entries failed verification", failed, len(entries))
+	}
+
+	return nil
+}
+
+// verify verifies e under a shared lock, so that a build can't change it
+// meanwhile, and removes it if it fails and --remove is set.
+func (cmd *CacheVerifyCmd) verify(e *cache.Entry) (bool, error) {
+	if err := e.Lock(false); err != nil {
+		return false, err
+	}
+	defer e.Unlock()
+
+	if err := e.Verify(); err != nil {
+		fmt.Printf("%s: %v\n", shortKey(e.Key), err)
+
+		if cmd.Remove {
+			if err := e.Lock(true); err != nil {
+				return false, err
+			}
+			if err := e.Remove(); err != nil {
+				return false, fmt.Errorf("failed to remove %s: %w", e.Key, err)
+			}
+			fmt.Printf("removed %s\n", shortKey(e.Key))
+		}
+		return false, nil
+	}
+
+	fmt.Printf("%s: ok\n", shortKey(e.Key))
+	return true, nil
+}
+
+func shortKey(key string) string {
+	const maxLen = 19
+	if len(key) > maxLen {
+		return key[:maxLen]
+	}
+	return key
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+type SpecCmd struct {
+	Lint   SpecLintCmd   `cmd:"" help:"Check build specs for errors"`
+	Render SpecRenderCmd `cmd:"" help:"Print a build spec merged with the specs it extends"`
+	Update SpecUpdateCmd `cmd:"" help:"Update a build spec to the newest release found by its update steps"`
+}
+
+type SpecLintCmd struct {
+	Specs []string          `arg:"" optional:"" default:"pipod.toml" help:"Paths to build specs"`
+	Set   map[string]string `help:"Set a build spec variable (key=value), overriding its [vars] value"`
+}
+
+func (cmd *SpecLintCmd) Run() error {
+	var problems int
+	for _, path := range cmd.Specs {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read toml: %w", err)
+		}
+
+		_, errs := parseSpec(path, data, cmd.Set)
+		for _, err := range errs {
+			fmt.Println(err)
+		}
+		if len(errs) == 0 {
+			fmt.Printf("%s: ok\n", path)
+		}
+		problems += len(errs)
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("found %d problems", problems)
+	}
+
+	return nil
+}
+
+type SpecRenderCmd struct {
+	Spec string            `arg:"" optional:"" default:"pipod.toml" help:"Path to build spec"`
+	Set  map[string]string `help:"Set a build spec variable (key=value), overriding its [vars] value"`
+}
+
+func (cmd *SpecRenderCmd) Run() error {
+	data, err := os.ReadFile(cmd.Spec)
+	if err != nil {
+		return fmt.Errorf("failed to read toml: %w", err)
+	}
+
+	spec, errs := parseSpec(cmd.Spec, data, cmd.Set)
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	out, err := spec.render()
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+// render returns the spec as pipod spec render prints it, merged with the
+// specs it extends and with its variables substituted.
+func (s Spec) render() ([]byte, error) {
+	// variables have been replaced in the labels, and update steps need
+	// them
+	s.Vars = nil
+	s.Update = nil
+
+	out, err := toml.Marshal(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal toml: %w", err)
+	}
+	return out, nil
+}
+
+type SpecUpdateCmd struct {
+	Spec string `arg:"" optional:"" default:"pipod.toml" help:"Path to build spec"`
+	Out  string `short:"o" help:"Write the updated build spec to this path instead of updating it in place"`
+}
+
+func (cmd *SpecUpdateCmd) Run(ctx context.Context, globals *Globals) error {
+	sf, err := globals.sourceFetcher(globals.events(false, false))
+	if err != nil {
+		return err
+	}
+	sf.dir = filepath.Dir(cmd.Spec)
+
+	return cmd.update(ctx, sf)
+}
+
+func (cmd *SpecUpdateCmd) update(ctx context.Context, sf *sourceFetcher) error {
+	data, err := os.ReadFile(cmd.Spec)
+	if err != nil {
+		return fmt.Errorf("failed to read toml: %w", err)
+	}
+
+	spec, errs := parseSpec(cmd.Spec, data, nil)
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if len(spec.Update) == 0 {
+		return fmt.Errorf("%s has no update steps", cmd.Spec)
+	}
+
+	d := sf.newDownloader()
+
+	release, err := findRelease(ctx, d, spec)
+	if err != nil {
+		return err
+	}
+
+	// values to set in the spec file, keyed like keyLines
+	values := map[string]string{}
+	for name, value := range release {
+		if spec.Vars[name] != value {
+			values["vars\x00"+name] = value
+		}
+	}
+
+	if len(values) == 0 {
+		fmt.Printf("%s: up to date\n", cmd.Spec)
+		return nil
+	}
+
+	updated, errs := parseSpec(cmd.Spec, data, release)
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(updated.Platform)) {
+		labels := updated.Platform[name].pipod
+		if labels.SourceSHA256 == "" {
+			continue
+		}
+
+		sum, err := sf.withPlatform(name).sourceSHA256(ctx, d, labels)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		values[strings.Join([]string{"platform", name, "labels", labelSourceSHA256}, "\x00")] = sum
+	}
+
+	out := cmp.Or(cmd.Out, cmd.Spec)
+	if extends := rawExtends(data); extends != "" && !filepath.IsAbs(extends) && filepath.Dir(out) != filepath.Dir(cmd.Spec) {
+		base := filepath.Join(filepath.Dir(cmd.Spec), extends)
+		if values["extends"], err = filepath.Rel(filepath.Dir(out), base); err != nil {
+			return fmt.Errorf("failed to resolve %s from %s: %w", base, out, err)
+		}
+	}
+
+	outData, err := setValues(data, values)
+	if err != nil {
+		return fmt.Errorf("failed to update %s: %w", cmd.Spec, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return fmt.Errorf("failed to make dir: %w", err)
+	}
+	if err := os.WriteFile(out, outData, 0644); err != nil {
+		return fmt.Errorf("failed to write toml: %w", err)
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		fmt.Printf("%s: %s = %s\n", out, tomlKey(strings.Split(key, "\x00")), tomlString(values[key]))
+	}
+
+	return nil
+}
+
+// rawExtends returns the extends key of the spec data as written.
+func rawExtends(data []byte) string {
+	var spec struct {
+		Extends string `toml:"extends"`
+	}
+	toml.Unmarshal(data, &spec)
+	return spec.Extends
+}
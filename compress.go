@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/gaboose/pipod/internal/event"
+	"github.com/gaboose/pipod/internal/iio"
+	"github.com/mholt/archives"
+)
+
+// compressions are the compression formats pipod reads source images in and
+// writes disk images in, picked by file extension.
+var compressions = []archives.Compression{
+	archives.Brotli{},
+	archives.Bz2{},
+	archives.Gz{Multithreaded: true},
+	archives.Lz4{},
+	archives.Lzip{},
+	archives.MinLZ{},
+	archives.Sz{},
+	archives.Xz{},
+	archives.Zlib{},
+	archives.Zstd{},
+}
+
+// compression returns the compression format of name by its extension, or
+// nil if it has none.
+func compression(name string) archives.Compression {
+	ext := filepath.Ext(name)
+	for _, c := range compressions {
+		if ext == c.Extension() {
+			return c
+		}
+	}
+	return nil
+}
+
+func removeArchiveExt(name string) string {
+	if compression(name) == nil {
+		return name
+	}
+	return name[:len(name)-len(filepath.Ext(name))]
+}
+
+// compressFile compresses src into dst with c and returns the sha256 hash of
+// dst.
+func compressFile(ctx context.Context, events *event.Emitter, c archives.Compressor, src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", fmt.Errorf("failed to open: %w", err)
+	}
+	defer in.Close()
+
+	st, err := in.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to stat: %w", err)
+	}
+
+	var rc io.ReadCloser = io.NopCloser(iio.ContextReader(ctx, in))
+	rc = progress(rc, events.Progress(event.PhaseCompress, st.Size()))
+	defer rc.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", fmt.Errorf("failed to create: %w", err)
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	w, err := c.OpenWriter(io.MultiWriter(out, h))
+	if err != nil {
+		return "", fmt.Errorf("failed to open compressor: %w", err)
+	}
+
+	if _, err := io.Copy(w, rc); err != nil {
+		w.Close()
+		return "", fmt.Errorf("failed to compress: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("failed to close compressor: %w", err)
+	}
+
+	if err := out.Close(); err != nil {
+		return "", fmt.Errorf("failed to close: %w", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeSHA256File writes the sha256 hash of name to name.sha256 in the format
+// of sha256sum, so that sha256sum -c can check it.
+func writeSHA256File(name, sum string) error {
+	line := fmt.Sprintf("%s  %s\n", sum, filepath.Base(name))
+	if err := os.WriteFile(name+".sha256", []byte(line), 0644); err != nil {
+		return fmt.Errorf("failed to write %s.sha256: %w", name, err)
+	}
+	return nil
+}
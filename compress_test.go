@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mholt/archives"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoveArchiveExt(t *testing.T) {
+	assert.Equal(t, "out.img", removeArchiveExt("out.img.xz"))
+	assert.Equal(t, "out.img", removeArchiveExt("out.img.zst"))
+	assert.Equal(t, "out.img", removeArchiveExt("out.img"))
+	assert.Equal(t, "out.tar", removeArchiveExt("out.tar.gz"))
+}
+
+func TestCompressFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "out.img.part")
+	content := bytes.Repeat([]byte("pipod\x00\x00\x00"), 1<<16)
+	require.NoError(t, os.WriteFile(src, content, 0644))
+
+	for _, name := range []string{"out.img.xz", "out.img.zst", "out.img.gz", "out.img.bz2"} {
+		c := compression(name)
+		require.NotNil(t, c, name)
+
+		dst := filepath.Join(dir, name)
+		sum, err := compressFile(context.Background(), discardEvents, c, src, dst)
+		require.NoError(t, err, name)
+
+		compressed, err := os.ReadFile(dst)
+		require.NoError(t, err)
+		h := sha256.Sum256(compressed)
+		assert.Equal(t, hex.EncodeToString(h[:]), sum, name)
+
+		format, _, err := archives.Identify(context.Background(), "", bytes.NewReader(compressed))
+		require.NoError(t, err, name)
+		assert.Equal(t, c.Extension(), format.Extension(), name)
+
+		r, err := c.OpenReader(bytes.NewReader(compressed))
+		require.NoError(t, err, name)
+		decompressed, err := io.ReadAll(r)
+		require.NoError(t, err, name)
+		assert.Equal(t, content, decompressed, name)
+	}
+}
+
+func TestWriteSHA256File(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "out.img.xz")
+	require.NoError(t, writeSHA256File(name, "abc123"))
+
+	data, err := os.ReadFile(name + ".sha256")
+	require.NoError(t, err)
+	assert.Equal(t, "abc123  out.img.xz\n", string(data))
+}
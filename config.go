@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// Config is the user configuration of pipod. It is read from
+// $XDG_CONFIG_HOME/pipod/config.toml by default:
+//
+//	proxy = "http://proxy.example.com:3128"
+//	ca-bundle = "/etc/pipod/ca.pem"
+//
+//	[hosts."api.github.com".headers]
+//	Accept = "application/octet-stream"
+//	Authorization = "Bearer ${GITHUB_TOKEN}"
+type Config struct {
+	Proxy    string                `toml:"proxy"`
+	CABundle string                `toml:"ca-bundle"`
+	Netrc    string                `toml:"netrc"`
+	Hosts    map[string]HostConfig `toml:"hosts"`
+}
+
+// HostConfig applies to requests to a host or host:port.
+type HostConfig struct {
+	// Headers are extra request headers. Environment variables in values are
+	// expanded.
+	Headers map[string]string `toml:"headers"`
+}
+
+func defaultConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find user config dir: %w", err)
+	}
+
+	return filepath.Join(dir, "pipod", "config.toml"), nil
+}
+
+// loadConfig reads the config file at path. A missing file is an empty
+// config unless required is set.
+func loadConfig(path string, required bool) (*Config, error) {
+	var config Config
+
+	tomlBts, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		return &config, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	if err := toml.Unmarshal(tomlBts, &config); err != nil {
+		return nil, fmt.Errorf("failed to load config %s: %w", path, err)
+	}
+
+	return &config, nil
+}
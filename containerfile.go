@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// containerfileNames are the files podman build reads in order of preference.
+var containerfileNames = []string{"Containerfile", "Dockerfile"}
+
+// baseImage returns the image the final stage of the Containerfile in dir is
+// built from. It returns "" if the image isn't known before the build, e.g.
+// if it is set by a build argument or is scratch.
+func baseImage(dir string) (string, error) {
+	for _, name := range containerfileNames {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return "", fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		return parseBaseImage(data), nil
+	}
+	return "", fmt.Errorf("no Containerfile or Dockerfile found in %s", dir)
+}
+
+// parseBaseImage returns the image the final stage of the Containerfile data
+// is built from, following stages built from other stages.
+func parseBaseImage(data []byte) string {
+	stages := map[string]string{}
+	var image string
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	var line string
+	for scanner.Scan() {
+		// instructions continue on the next line after a backslash
+		if text, ok := strings.CutSuffix(strings.TrimSpace(scanner.Text()), `\`); ok {
+			line += text + " "
+			continue
+		} else {
+			line += text
+		}
+
+		fields := strings.Fields(line)
+		line = ""
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+
+		// skip flags, e.g. --platform=$BUILDPLATFORM
+		args := fields[1:]
+		for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		image = args[0]
+		if stage, ok := stages[strings.ToLower(image)]; ok {
+			image = stage
+		}
+		if len(args) == 3 && strings.EqualFold(args[1], "AS") {
+			stages[strings.ToLower(args[2])] = image
+		}
+	}
+
+	if strings.Contains(image, "$") || image == "scratch" {
+		return ""
+	}
+	return image
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBaseImage(t *testing.T) {
+	for containerfile, want := range map[string]string{
+		"FROM ghcr.io/gaboose/raspios:trixie-lite\nRUN apt-get update\n":                  "ghcr.io/gaboose/raspios:trixie-lite",
+		"# syntax=docker/dockerfile:1\nfrom --platform=linux/arm64 raspios AS base\n":     "raspios",
+		"FROM golang AS build\nRUN go build\nFROM raspios\nCOPY --from=build /app /app\n": "raspios",
+		"FROM raspios AS base\nRUN apt-get update\nFROM base\n":                           "raspios",
+		"FROM \\\n  --platform=linux/arm64 \\\n  raspios\n":                               "raspios",
+		"ARG BASE=raspios\nFROM $BASE\n":                                                  "",
+		"FROM raspios AS base\nFROM scratch\nCOPY --from=base / /\n":                      "",
+		"RUN true\n": "",
+	} {
+		assert.Equal(t, want, parseBaseImage([]byte(containerfile)), containerfile)
+	}
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gaboose/afero-guestfs/libguestfs.org/guestfs"
+	"github.com/gaboose/pipod/internal/event"
+	"github.com/gaboose/pipod/internal/guestfish"
+	"github.com/google/uuid"
+)
+
+const (
+	sectorSize = 512
+
+	// partitionAlign is what partitions of disk images created from scratch
+	// are aligned to. Like raspios, the first partition starts at 4 MiB,
+	// which suits the erase blocks of SD cards.
+	partitionAlign = 4 << 20
+
+	// gptBackupSize is the space the backup GPT takes at the end of a disk.
+	gptBackupSize = 33 * sectorSize
+)
+
+// DiskSpec is the partition layout of disk images built with disk build
+// --from-scratch.
+type DiskSpec struct {
+	// Table is the partition table type, msdos (default) or gpt.
+	Table string `toml:"table,omitempty"`
+	// ID is the disk identifier, e.g. a1b2c3d4 for msdos or a GUID for gpt.
+	ID string `toml:"id,omitempty"`
+	// Size is the size of the disk image, e.g. 4G. It defaults to the size
+	// of the partitions.
+	Size      string          `toml:"size,omitempty"`
+	Partition []PartitionSpec `toml:"partition"`
+}
+
+// PartitionSpec is a partition of DiskSpec. Partitions are laid out in order.
+type PartitionSpec struct {
+	// FSType is the filesystem of the partition: vfat, ext2, ext3 or ext4.
+	FSType string `toml:"fstype"`
+	// Size is the size of the partition, e.g. 512M. The last partition
+	// fills the rest of the disk if it has no size.
+	Size  string `toml:"size,omitempty"`
+	Label string `toml:"label,omitempty"`
+	UUID  string `toml:"uuid,omitempty"`
+}
+
+// mbrIDs are the msdos partition types of the filesystems of PartitionSpec.
+var mbrIDs = map[string]int{
+	"vfat": 0x0c,
+	"ext2": 0x83,
+	"ext3": 0x83,
+	"ext4": 0x83,
+}
+
+// layout returns the partition layout of d. The last partition has size 0
+// if it fills the rest of the disk.
+func (d *DiskSpec) layout() (*diskLayout, error) {
+	layout := &diskLayout{Table: withDefault(d.Table, "msdos"), ID: d.ID}
+	if layout.Table != "msdos" && layout.Table != "gpt" {
+		return nil, fmt.Errorf("table: unknown partition table %q, expected msdos or gpt", layout.Table)
+	}
+
+	if d.ID != "" && !isDiskID(layout.Table, d.ID) {
+		return nil, fmt.Errorf("id: invalid %s disk identifier %q", layout.Table, d.ID)
+	}
+
+	if d.Size != "" {
+		size, err := parseSize(d.Size)
+		if err != nil {
+			return nil, fmt.Errorf("size: %w", err)
+		}
+		layout.Size = size
+	}
+
+	if len(d.Partition) == 0 {
+		return nil, fmt.Errorf("no partitions")
+	}
+
+	start := int64(partitionAlign)
+	for i, p := range d.Partition {
+		if _, ok := mbrIDs[p.FSType]; !ok {
+			return nil, fmt.Errorf("partition.%d.fstype: unknown filesystem %q, expected vfat, ext2, ext3 or ext4", i, p.FSType)
+		}
+
+		if p.UUID != "" && !isFilesystemUUID(p.FSType, p.UUID) {
+			return nil, fmt.Errorf("partition.%d.uuid: invalid %s uuid %q", i, p.FSType, p.UUID)
+		}
+
+		part := partitionLayout{
+			Device: fmt.Sprintf("/dev/sda%d", i+1),
+			Start:  start,
+			FSType: p.FSType,
+			UUID:   p.UUID,
+			Label:  p.Label,
+		}
+
+		if p.Size != "" {
+			size, err := parseSize(p.Size)
+			if err != nil {
+				return nil, fmt.Errorf("partition.%d.size: %w", i, err)
+			}
+			part.Size = alignUp(size, partitionAlign)
+		} else if i < len(d.Partition)-1 {
+			return nil, fmt.Errorf("partition.%d.size: only the last partition can fill the disk", i)
+		}
+
+		layout.Partitions = append(layout.Partitions, part)
+		start += part.Size
+	}
+
+	if layout.Size == 0 && layout.Partitions[len(layout.Partitions)-1].Size > 0 {
+		// the disk ends aligned too, with room for a backup GPT
+		layout.Size = start + partitionAlign
+	}
+
+	return layout, nil
+}
+
+// parseSize parses a size in bytes with an optional binary suffix, e.g. 512M
+// or 4GiB.
+func parseSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), "I")
+
+	var shift int
+	if i := strings.IndexAny(num, "KMGT"); i >= 0 && i == len(num)-1 {
+		shift = 10 * (strings.IndexByte("KMGT", num[i]) + 1)
+		num = num[:i]
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > (1<<62)>>shift {
+		return 0, fmt.Errorf("invalid size %q, expected e.g. 512M or 4G", s)
+	}
+	return n << shift, nil
+}
+
+// isDiskID reports whether id is a disk identifier of a table: 8 hex digits
+// for msdos, a GUID for gpt.
+func isDiskID(table, id string) bool {
+	if table == "gpt" {
+		return uuid.Validate(id) == nil
+	}
+	return isHex(id, 8)
+}
+
+// isFilesystemUUID reports whether id is a UUID of a fstype filesystem, e.g.
+// 4A3F-1B2C for vfat.
+func isFilesystemUUID(fstype, id string) bool {
+	if fstype == "vfat" {
+		a, b, ok := strings.Cut(id, "-")
+		return ok && isHex(a, 4) && isHex(b, 4)
+	}
+	return uuid.Validate(id) == nil
+}
+
+// parseDiskSize parses the size of a disk image, e.g. 8G, or how much to
+// add to size, e.g. +2G.
+func parseDiskSize(s string, size int64) (int64, error) {
+	if added, ok := strings.CutPrefix(strings.TrimSpace(s), "+"); ok {
+		n, err := parseSize(added)
+		if err != nil {
+			return 0, err
+		}
+		return size + n, nil
+	}
+	return parseSize(s)
+}
+
+func alignUp(n, align int64) int64 {
+	return (n + align - 1) / align * align
+}
+
+// createDiskImage creates a disk image of size with the partitions and
+// filesystems of layout. A partition of size 0 fills the rest of the disk.
+func createDiskImage(image string, layout *diskLayout, size int64) error {
+	end := size
+	if layout.Table == "gpt" {
+		end -= gptBackupSize
+	}
+	for i, p := range layout.Partitions {
+		if want := fmt.Sprintf("/dev/sda%d", i+1); p.Device != want {
+			return fmt.Errorf("partition %s is partition %d, expected %s", p.Device, i+1, want)
+		}
+		if _, ok := mbrIDs[p.FSType]; !ok {
+			return fmt.Errorf("partition %s has filesystem %q, only vfat, ext2, ext3 and ext4 partitions can be created", p.Device, p.FSType)
+		}
+		if p.Start+p.Size > end || (p.Size == 0 && p.Start >= end) {
+			return fmt.Errorf("partition %s doesn't fit a disk image of %s", p.Device, event.ByteCountIEC(size))
+		}
+	}
+
+	f, err := os.Create(image)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", image, err)
+	}
+	// a sparse file, blocks are only allocated when written
+	err = f.Truncate(size)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to resize %s: %w", image, err)
+	}
+
+	g, err := launchGuestfs(image, false)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+
+	const device = "/dev/sda"
+	if err := g.Part_init(device, layout.Table); err != nil {
+		return fmt.Errorf("failed to create partition table: %w", err)
+	}
+
+	for i, p := range layout.Partitions {
+		lastSector := (p.Start+p.Size)/sectorSize - 1
+		if p.Size == 0 {
+			lastSector = end/sectorSize - 1
+		}
+		if err := g.Part_add(device, "p", p.Start/sectorSize, lastSector); err != nil {
+			return fmt.Errorf("failed to add partition %s: %w", p.Device, err)
+		}
+
+		switch layout.Table {
+		case "msdos":
+			if err := g.Part_set_mbr_id(device, i+1, mbrIDs[p.FSType]); err != nil {
+				return fmt.Errorf("failed to set partition type of %s: %w", p.Device, err)
+			}
+		case "gpt":
+			if p.PartUUID == "" {
+				break
+			}
+			if err := g.Part_set_gpt_guid(device, i+1, p.PartUUID); err != nil {
+				return fmt.Errorf("failed to set partuuid of %s: %w", p.Device, err)
+			}
+		}
+	}
+
+	if layout.ID != "" {
+		if err := setDiskID(g, device, layout.Table, layout.ID); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range layout.Partitions {
+		opts := &guestfs.OptargsMkfs{Label_is_set: p.Label != "", Label: p.Label}
+		if err := g.Mkfs(p.FSType, p.Device, opts); err != nil {
+			return fmt.Errorf("failed to make %s filesystem on %s: %w", p.FSType, p.Device, err)
+		}
+
+		if p.UUID != "" {
+			if err := setFilesystemUUID(g, p); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := g.Shutdown(); err != nil {
+		return fmt.Errorf("guestfs shutdown failed: %w", err)
+	}
+	return nil
+}
+
+// emptyPartitions returns the partitions of layout that none of mounts
+// mounts, which a disk image created from scratch leaves empty, e.g. a boot
+// partition that the container image doesn't import.
+func emptyPartitions(layout *diskLayout, mounts []guestfish.Mount) []partitionLayout {
+	var empty []partitionLayout
+	for _, p := range layout.Partitions {
+		if !slices.ContainsFunc(mounts, func(m guestfish.Mount) bool { return m.Device == p.Device }) {
+			empty = append(empty, p)
+		}
+	}
+	return empty
+}
+
+// growDiskImage grows image to size, and its last partition and filesystem
+// with it.
+func growDiskImage(image string, size int64) error {
+	if err := os.Truncate(image, size); err != nil {
+		return fmt.Errorf("failed to resize %s: %w", image, err)
+	}
+
+	g, err := launchGuestfs(image, false)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+
+	layout, err := readDiskLayout(g)
+	if err != nil {
+		return err
+	}
+	if len(layout.Partitions) == 0 {
+		return fmt.Errorf("the disk image has no partitions to grow")
+	}
+	last := layout.Partitions[len(layout.Partitions)-1]
+	if !slices.Contains([]string{"ext2", "ext3", "ext4"}, last.FSType) {
+		return fmt.Errorf("can't grow the %q filesystem of %s, only ext2, ext3 and ext4", last.FSType, last.Device)
+	}
+
+	device, err := g.Part_to_dev(last.Device)
+	if err != nil {
+		return fmt.Errorf("failed to get disk of %s: %w", last.Device, err)
+	}
+	partnum, err := g.Part_to_partnum(last.Device)
+	if err != nil {
+		return fmt.Errorf("failed to get partition number of %s: %w", last.Device, err)
+	}
+
+	end := size
+	if layout.Table == "gpt" {
+		// the backup GPT moves to the new end of the disk
+		if err := g.Part_expand_gpt(device); err != nil {
+			return fmt.Errorf("failed to move backup GPT: %w", err)
+		}
+		end -= gptBackupSize
+	}
+
+	if err := g.Part_resize(device, partnum, end/sectorSize-1); err != nil {
+		return fmt.Errorf("failed to resize partition %s: %w", last.Device, err)
+	}
+
+	// resize2fs refuses to resize filesystems that weren't just checked
+	if err := g.E2fsck_f(last.Device); err != nil {
+		return fmt.Errorf("failed to check filesystem of %s: %w", last.Device, err)
+	}
+	if err := g.Resize2fs(last.Device); err != nil {
+		return fmt.Errorf("failed to resize filesystem of %s: %w", last.Device, err)
+	}
+
+	if err := g.Shutdown(); err != nil {
+		return fmt.Errorf("guestfs shutdown failed: %w", err)
+	}
+	return nil
+}
+
+// shrinkDiskImage shrinks the filesystem on root, the last partition of
+// image, to its minimum size plus headroom, and the partition and image with
+// it. The free space of all filesystems is zeroed. It returns the new size of
+// the image.
+func shrinkDiskImage(image, root string, headroom int64) (int64, error) {
+	g, err := launchGuestfs(image, false)
+	if err != nil {
+		return 0, err
+	}
+	defer g.Close()
+
+	layout, err := readDiskLayout(g)
+	if err != nil {
+		return 0, err
+	}
+	if len(layout.Partitions) == 0 {
+		return 0, fmt.Errorf("the disk image has no partitions to shrink")
+	}
+	last := layout.Partitions[len(layout.Partitions)-1]
+	if last.Device != root {
+		return 0, fmt.Errorf("the root filesystem on %s can't shrink as it isn't the last partition", root)
+	}
+	if !slices.Contains([]string{"ext2", "ext3", "ext4"}, last.FSType) {
+		return 0, fmt.Errorf("can't shrink the %q filesystem of %s, only ext2, ext3 and ext4", last.FSType, last.Device)
+	}
+
+	// resize2fs refuses to resize filesystems that weren't just checked
+	if err := g.E2fsck_f(last.Device); err != nil {
+		return 0, fmt.Errorf("failed to check filesystem of %s: %w", last.Device, err)
+	}
+
+	minSize, err := g.Vfs_minimum_size(last.Device)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get minimum size of %s: %w", last.Device, err)
+	}
+
+	size := alignUp(minSize+headroom, partitionAlign)
+	if size < last.Size {
+		if err := g.Resize2fs_size(last.Device, size); err != nil {
+			return 0, fmt.Errorf("failed to resize filesystem of %s: %w", last.Device, err)
+		}
+
+		device, err := g.Part_to_dev(last.Device)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get disk of %s: %w", last.Device, err)
+		}
+		partnum, err := g.Part_to_partnum(last.Device)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get partition number of %s: %w", last.Device, err)
+		}
+		if err := g.Part_resize(device, partnum, (last.Start+size)/sectorSize-1); err != nil {
+			return 0, fmt.Errorf("failed to resize partition %s: %w", last.Device, err)
+		}
+		last.Size = size
+	}
+
+	// zeroed blocks take no space in sparse and compressed images
+	for _, p := range layout.Partitions {
+		switch p.FSType {
+		case "ext2", "ext3", "ext4":
+			if err := g.Zerofree(p.Device); err != nil {
+				return 0, fmt.Errorf("failed to zero free space of %s: %w", p.Device, err)
+			}
+		case "vfat":
+			if err := g.Mount(p.Device, "/"); err != nil {
+				return 0, fmt.Errorf("failed to mount %s: %w", p.Device, err)
+			}
+			if err := g.Zero_free_space("/"); err != nil {
+				return 0, fmt.Errorf("failed to zero free space of %s: %w", p.Device, err)
+			}
+			if err := g.Umount_all(); err != nil {
+				return 0, fmt.Errorf("umount all failed: %w", err)
+			}
+		}
+	}
+
+	if err := g.Shutdown(); err != nil {
+		return 0, fmt.Errorf("guestfs shutdown failed: %w", err)
+	}
+
+	newSize := last.Start + last.Size
+	if layout.Table == "gpt" {
+		newSize += gptBackupSize
+	}
+	if err := os.Truncate(image, newSize); err != nil {
+		return 0, fmt.Errorf("failed to resize %s: %w", image, err)
+	}
+
+	if layout.Table == "gpt" {
+		// the backup GPT was cut off with the end of the disk
+		if err := moveBackupGPT(image); err != nil {
+			return 0, err
+		}
+	}
+
+	return newSize, nil
+}
+
+// moveBackupGPT writes the backup GPT of image to its end.
+func moveBackupGPT(image string) error {
+	g, err := launchGuestfs(image, false)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+
+	if err := g.Part_expand_gpt("/dev/sda"); err != nil {
+		return fmt.Errorf("failed to move backup GPT: %w", err)
+	}
+
+	if err := g.Shutdown(); err != nil {
+		return fmt.Errorf("guestfs shutdown failed: %w", err)
+	}
+	return nil
+}
+
+// setDiskID sets the disk identifier of device. libguestfs can only set
+// those of gpt disks, so the signature of msdos disks is written into the
+// MBR directly.
+func setDiskID(g *guestfs.Guestfs, device, table, id string) error {
+	if table == "gpt" {
+		if err := g.Part_set_disk_guid(device, id); err != nil {
+			return fmt.Errorf("failed to set disk identifier: %w", err)
+		}
+		return nil
+	}
+
+	sig, err := hex.DecodeString(id)
+	if err != nil || len(sig) != 4 {
+		return fmt.Errorf("invalid msdos disk identifier %q", id)
+	}
+
+	// the identifier is the little-endian number at offset 440
+	if _, err := g.Pwrite_device(device, []byte{sig[3], sig[2], sig[1], sig[0]}, 440); err != nil {
+		return fmt.Errorf("failed to set disk identifier: %w", err)
+	}
+	return nil
+}
+
+// setFilesystemUUID sets the UUID of the filesystem of p. libguestfs can't
+// set those of vfat filesystems, so their volume ID is written into the boot
+// sector directly.
+func setFilesystemUUID(g *guestfs.Guestfs, p partitionLayout) error {
+	if p.FSType != "vfat" {
+		if err := g.Set_uuid(p.Device, p.UUID); err != nil {
+			return fmt.Errorf("failed to set uuid of %s: %w", p.Device, err)
+		}
+		return nil
+	}
+
+	// e.g. 4A3F-1B2C
+	id, err := hex.DecodeString(strings.ReplaceAll(p.UUID, "-", ""))
+	if err != nil || len(id) != 4 {
+		return fmt.Errorf("invalid vfat uuid %q of %s", p.UUID, p.Device)
+	}
+
+	boot, err := g.Pread_device(p.Device, sectorSize, 0)
+	if err != nil {
+		return fmt.Errorf("failed to read boot sector of %s: %w", p.Device, err)
+	}
+	if len(boot) < sectorSize {
+		return fmt.Errorf("failed to read boot sector of %s: short read", p.Device)
+	}
+
+	// FAT32 has no 16-bit sectors per FAT count and a longer header
+	offset := int64(39)
+	if binary.LittleEndian.Uint16(boot[22:24]) == 0 {
+		offset = 67
+	}
+
+	if _, err := g.Pwrite_device(p.Device, []byte{id[3], id[2], id[1], id[0]}, offset); err != nil {
+		return fmt.Errorf("failed to set uuid of %s: %w", p.Device, err)
+	}
+	return nil
+}
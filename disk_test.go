@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gaboose/pipod/internal/guestfish"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSize(t *testing.T) {
+	for s, want := range map[string]int64{
+		"512":   512,
+		"512M":  512 << 20,
+		"4G":    4 << 30,
+		"4GiB":  4 << 30,
+		"4gb":   4 << 30,
+		" 1T ":  1 << 40,
+		"100K":  100 << 10,
+		"0":     0,
+		"8192B": 8192,
+	} {
+		size, err := parseSize(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, size, s)
+	}
+
+	for _, s := range []string{"", "G", "4.5G", "-1G", "4X", "4GG", "99999999999T"} {
+		_, err := parseSize(s)
+		assert.EqualError(t, err, `invalid size "`+s+`", expected e.g. 512M or 4G`, s)
+	}
+}
+
+func TestParseDiskSize(t *testing.T) {
+	size, err := parseDiskSize("8G", 4<<30)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8<<30), size)
+
+	size, err = parseDiskSize(" +2G", 4<<30)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6<<30), size)
+
+	_, err = parseDiskSize("+-2G", 4<<30)
+	assert.EqualError(t, err, `invalid size "-2G", expected e.g. 512M or 4G`)
+}
+
+func TestDiskSpecLayout(t *testing.T) {
+	layout, err := (&DiskSpec{
+		ID: "a1b2c3d4",
+		Partition: []PartitionSpec{
+			{FSType: "vfat", Size: "510M", Label: "bootfs", UUID: "4EF5-6F55"},
+			{FSType: "ext4", Size: "2G", Label: "rootfs"},
+		},
+	}).layout()
+	require.NoError(t, err)
+	assert.Equal(t, &diskLayout{
+		Table: "msdos",
+		ID:    "a1b2c3d4",
+		Size:  (4 + 512 + 2048 + 4) << 20,
+		Partitions: []partitionLayout{
+			{Device: "/dev/sda1", Start: 4 << 20, Size: 512 << 20, FSType: "vfat", UUID: "4EF5-6F55", Label: "bootfs"},
+			{Device: "/dev/sda2", Start: (4 + 512) << 20, Size: 2 << 30, FSType: "ext4", Label: "rootfs"},
+		},
+	}, layout)
+
+	layout, err = (&DiskSpec{
+		Table:     "gpt",
+		Partition: []PartitionSpec{{FSType: "vfat", Size: "512M"}, {FSType: "ext4"}},
+	}).layout()
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), layout.Size)
+	assert.Equal(t, partitionLayout{Device: "/dev/sda2", Start: (4 + 512) << 20, FSType: "ext4"}, layout.Partitions[1])
+
+	for msg, spec := range map[string]DiskSpec{
+		`table: unknown partition table "mbr", expected msdos or gpt`: {Table: "mbr", Partition: []PartitionSpec{{FSType: "ext4"}}},
+		`id: invalid msdos disk identifier "a1b2"`:                    {ID: "a1b2", Partition: []PartitionSpec{{FSType: "ext4"}}},
+		`id: invalid gpt disk identifier "a1b2c3d4"`:                  {Table: "gpt", ID: "a1b2c3d4", Partition: []PartitionSpec{{FSType: "ext4"}}},
+		`size: invalid size "big", expected e.g. 512M or 4G`:          {Size: "big", Partition: []PartitionSpec{{FSType: "ext4"}}},
+		`no partitions`: {Size: "4G"},
+		`partition.0.fstype: unknown filesystem "fat32", expected vfat, ext2, ext3 or ext4`: {Partition: []PartitionSpec{{FSType: "fat32"}}},
+		`partition.0.size: only the last partition can fill the disk`:                       {Partition: []PartitionSpec{{FSType: "vfat"}, {FSType: "ext4"}}},
+		`partition.1.uuid: invalid ext4 uuid "4EF5-6F55"`:                                   {Partition: []PartitionSpec{{FSType: "vfat", Size: "512M"}, {FSType: "ext4", UUID: "4EF5-6F55"}}},
+		`partition.0.uuid: invalid vfat uuid "ce208fd3-38a8-424a-87a2-cd44114eb820"`:        {Partition: []PartitionSpec{{FSType: "vfat", UUID: "ce208fd3-38a8-424a-87a2-cd44114eb820"}}},
+	} {
+		_, err := spec.layout()
+		assert.EqualError(t, err, msg)
+	}
+}
+
+func TestCreateLayout(t *testing.T) {
+	// the layout recorded from a source image
+	labels := PipodLabels{SourceDiskLayout: `{"table":"msdos","id":"a1b2c3d4","size":2692743168,"partitions":[` +
+		`{"device":"/dev/sda1","start":4194304,"size":536870912,"fstype":"vfat"},` +
+		`{"device":"/dev/sda2","start":541065216,"size":2151677952,"fstype":"ext4"}]}`}
+
+	layout, size, err := (&DiskBuildCmd{}).createLayout(labels)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2692743168), size)
+	assert.Equal(t, int64(2151677952), layout.Partitions[1].Size)
+
+	// the last partition fills the disk of --size
+	layout, size, err = (&DiskBuildCmd{Size: "8G"}).createLayout(labels)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8<<30), size)
+	assert.Equal(t, int64(536870912), layout.Partitions[0].Size)
+	assert.Equal(t, int64(0), layout.Partitions[1].Size)
+
+	_, _, err = (&DiskBuildCmd{}).createLayout(PipodLabels{SourceDiskLayout: `{"table":"","size":1073741824,"partitions":null}`})
+	assert.EqualError(t, err, "the source image has no partition table to create, add a [disk] section to the build spec of the container image")
+}
+
+func TestEmptyPartitions(t *testing.T) {
+	layout := &diskLayout{Partitions: []partitionLayout{
+		{Device: "/dev/sda1", FSType: "vfat", Label: "bootfs"},
+		{Device: "/dev/sda2", FSType: "ext4", Label: "rootfs"},
+	}}
+
+	// the default mapping of sda2 leaves the boot partition empty
+	assert.Equal(t, layout.Partitions[:1], emptyPartitions(layout, []guestfish.Mount{{Device: "/dev/sda2", Mountpoint: "/"}}))
+	assert.Empty(t, emptyPartitions(layout, []guestfish.Mount{{Device: "/dev/sda2", Mountpoint: "/"}, {Device: "/dev/sda1", Mountpoint: "/boot/firmware"}}))
+}
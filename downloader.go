@@ -2,40 +2,24 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"net/http"
+	"io/fs"
 	"os"
+	"path"
 	"strings"
-	"sync/atomic"
-	"time"
 
+	"github.com/gaboose/pipod/internal/event"
 	"github.com/gaboose/pipod/internal/iio"
+	"github.com/gaboose/pipod/internal/sparse"
 	"github.com/mholt/archives"
 )
 
-func downloader(url string) (io.ReadCloser, int64) {
-	ctx, c := iio.ContextCloser()
-
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return c.WithErrReader(iio.NewErrorReader(fmt.Errorf("failed to make request"))), 0
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return c.WithErrReader(iio.NewErrorReader(fmt.Errorf("failed to make request"))), 0
-	}
-
-	return c.WithReadCloser(resp.Body), resp.ContentLength
-}
-
-func verifier(rc io.ReadCloser, expectedSum string) io.ReadCloser {
+func verifier(rc io.ReadCloser, h hash.Hash, expectedSum string) io.ReadCloser {
 	pr, pw := io.Pipe()
-	h := sha256.New()
 	mw := io.MultiWriter(pw, h)
 
 	go func() {
@@ -48,7 +32,7 @@ func verifier(rc io.ReadCloser, expectedSum string) io.ReadCloser {
 		got := h.Sum(nil)
 		gotHex := hex.EncodeToString(got)
 
-		if gotHex != expectedSum {
+		if gotHex != strings.ToLower(expectedSum) {
 			pw.CloseWithError(fmt.Errorf("checksum mismatch: got %s, want %s", gotHex, expectedSum))
 			return
 		}
@@ -60,7 +44,7 @@ func verifier(rc io.ReadCloser, expectedSum string) io.ReadCloser {
 }
 
 func decompresser(rc io.ReadCloser, url string) io.ReadCloser {
-	ctx, c := iio.ContextCloser()
+	ctx, c := iio.ContextCloser(context.Background())
 	c = iio.Closer(rc.Close).ChainCloser(c)
 
 	format, identifiedReader, err := archives.Identify(ctx, url, rc)
@@ -83,6 +67,52 @@ func decompresser(rc io.ReadCloser, url string) io.ReadCloser {
 	return c.WithReadCloser(decompReader)
 }
 
+// extractMember saves the first file in archive that matches glob to dest,
+// decompressing it if needed. The glob is matched against both the path of
+// the file in the archive and its base name.
+func extractMember(ctx context.Context, extractor archives.Extractor, archive io.Reader, glob string, dest string, events *event.Emitter) error {
+	if _, err := path.Match(glob, ""); err != nil {
+		return fmt.Errorf("invalid archive member pattern %q: %w", glob, err)
+	}
+
+	var found bool
+	err := extractor.Extract(ctx, archive, func(ctx context.Context, info archives.FileInfo) error {
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		nameMatch, _ := path.Match(glob, info.NameInArchive)
+		baseMatch, _ := path.Match(glob, path.Base(info.NameInArchive))
+		if !nameMatch && !baseMatch {
+			return nil
+		}
+		found = true
+
+		f, err := info.Open()
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", info.NameInArchive, err)
+		}
+
+		events.Start(event.PhaseExtract, "Extracting %s...", info.NameInArchive)
+		rc := progress(f, events.Progress(event.PhaseExtract, info.Size()))
+		rc = decompresser(rc, info.NameInArchive)
+		if err := save(rc, dest); err != nil {
+			return fmt.Errorf("%s: %w", info.NameInArchive, err)
+		}
+
+		return fs.SkipAll
+	})
+	if err != nil {
+		return fmt.Errorf("failed to extract: %w", err)
+	}
+
+	if !found {
+		return fmt.Errorf("no file in archive matches %q", glob)
+	}
+
+	return nil
+}
+
 func save(rc io.ReadCloser, dest string) error {
 	defer rc.Close()
 
@@ -92,7 +122,7 @@ func save(rc io.ReadCloser, dest string) error {
 	}
 	defer outFile.Close()
 
-	_, err = io.Copy(outFile, rc)
+	_, err = sparse.Copy(outFile, rc)
 	if err != nil {
 		return fmt.Errorf("failed to write to %s: %w", dest, err)
 	}
@@ -104,85 +134,12 @@ func save(rc io.ReadCloser, dest string) error {
 	return nil
 }
 
-func progress(rc io.ReadCloser, total int64, w io.Writer) io.ReadCloser {
-	var bytesRead int64
-	tck := time.NewTicker(40 * time.Millisecond)
-	ctx, cancel := context.WithCancel(context.Background())
-	printDone := make(chan struct{})
-
-	go func() {
-		var lastDisplay string
-
-		for {
-			select {
-			case <-tck.C:
-				current := atomic.LoadInt64(&bytesRead)
-
-				display := progressString(current, total)
-				if display == lastDisplay {
-					continue
-				}
-
-				fmt.Fprintf(w, "\r%s", display)
-				lastDisplay = display
-			case <-ctx.Done():
-				current := atomic.LoadInt64(&bytesRead)
-				fmt.Fprintf(w, "\r%s\n", progressString(current, total))
-				close(printDone)
-				return
-			}
-		}
-	}()
-
-	c := iio.Closer(rc.Close)
-	c = c.ChainCloser(iio.Closer(func() error {
-		// using a cancellable context instead of a "closing" channel so that
-		// Close can safely be called multiple times
-		cancel()
-		<-printDone
-		return nil
-	}))
-
+// progress reports the bytes read from rc to t and closes t with rc.
+func progress(rc io.ReadCloser, t *event.Tracker) io.ReadCloser {
+	c := iio.Closer(rc.Close).ChainCloser(t)
 	return c.WithReader(iio.Reader(func(p []byte) (n int, err error) {
 		n, err = rc.Read(p)
-		atomic.AddInt64(&bytesRead, int64(n))
+		t.Add(int64(n))
 		return
 	}))
 }
-
-func byteCountIEC(b int64) string {
-	const unit = 1024
-	if b < unit {
-		return fmt.Sprintf("%d B", b)
-	}
-	div, exp := int64(unit), 0
-	for n := b / unit; n >= unit; n /= unit {
-		div *= unit
-		exp++
-	}
-	return fmt.Sprintf("%.1f %ciB",
-		float64(b)/float64(div), "KMGTPE"[exp])
-}
-
-func progressString(current, total int64) string {
-	const WIDTH = 40
-
-	if total == 0 {
-		fillPos := int(time.Now().Unix() % WIDTH)
-		bar := strings.Repeat(" ", fillPos) + "=" + strings.Repeat(" ", WIDTH-fillPos-1)
-		return fmt.Sprintf("[%s] %-10s", bar, byteCountIEC(current))
-	}
-
-	filled := int(float64(current) / float64(total) * float64(WIDTH))
-	if filled > WIDTH {
-		filled = WIDTH
-	}
-
-	bar := strings.Repeat("=", filled)
-	if filled < WIDTH {
-		bar += ">" + strings.Repeat(" ", WIDTH-filled-1)
-	}
-	ratio := fmt.Sprintf("%s / %s", byteCountIEC(current), byteCountIEC(total))
-
-	return fmt.Sprintf("[%s] %-23s", bar, ratio)
-}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gaboose/pipod/internal/event"
+	"github.com/mholt/archives"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var discardEvents = event.NewEmitter(event.NewJSON(io.Discard))
+
+func TestExtractMember(t *testing.T) {
+	files := map[string]string{
+		"README.txt":         "readme",
+		"images/board.img":   "disk image",
+		"images/board.img.1": "other",
+	}
+
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	for name, contents := range files {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = io.WriteString(w, contents)
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+
+	var tarGzBuf bytes.Buffer
+	gw := gzip.NewWriter(&tarGzBuf)
+	tw := tar.NewWriter(gw)
+	for name, contents := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))}))
+		_, err := io.WriteString(tw, contents)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	for name, archive := range map[string][]byte{"source.zip": zipBuf.Bytes(), "source.tar.gz": tarGzBuf.Bytes()} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, name)
+			require.NoError(t, os.WriteFile(path, archive, 0644))
+
+			f, err := os.Open(path)
+			require.NoError(t, err)
+			defer f.Close()
+
+			format, _, err := archives.Identify(context.Background(), name, f)
+			require.NoError(t, err)
+			extractor, ok := format.(archives.Extractor)
+			require.True(t, ok)
+
+			for _, glob := range []string{"*.img", "images/board.img"} {
+				_, err = f.Seek(0, io.SeekStart)
+				require.NoError(t, err)
+
+				dest := filepath.Join(dir, "image")
+				require.NoError(t, extractMember(context.Background(), extractor, f, glob, dest, discardEvents))
+
+				got, err := os.ReadFile(dest)
+				require.NoError(t, err)
+				assert.Equal(t, "disk image", string(got))
+			}
+
+			_, err = f.Seek(0, io.SeekStart)
+			require.NoError(t, err)
+			err = extractMember(context.Background(), extractor, f, "*.wic", filepath.Join(dir, "image"), discardEvents)
+			assert.ErrorContains(t, err, `no file in archive matches "*.wic"`)
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/gaboose/pipod/internal/bmap"
+)
+
+// createBmap returns the block map of image in the format of bmaptool.
+func createBmap(image string) ([]byte, error) {
+	f, err := os.Open(image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open: %w", err)
+	}
+	defer f.Close()
+
+	b, err := bmap.Create(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Marshal()
+}
+
+// bmapPath returns where the block map of image is written and looked for,
+// next to it without its compression extension like bmaptool does, e.g.
+// out.img.bmap for out.img.xz.
+func bmapPath(image string) string {
+	return removeArchiveExt(image) + ".bmap"
+}
+
+// findBmap reads the block map next to image.
+func findBmap(image string) (*bmap.Bmap, error) {
+	path := image + ".bmap"
+	if _, err := os.Stat(path); err != nil {
+		path = bmapPath(image)
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no bmap file found next to %s, expected %s", image, path)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read bmap: %w", err)
+	}
+
+	b, err := bmap.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return b, nil
+}
+
+// openDevice opens device for writing an image to. A device is opened
+// exclusively, which fails if it's in use, like bmaptool does. A regular file
+// is truncated, so that none of its previous content is left past the image.
+func openDevice(device string) (*os.File, os.FileInfo, error) {
+	st, err := os.Stat(device)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to stat device: %w", err)
+	}
+
+	flag := os.O_WRONLY
+	if st.Mode()&os.ModeDevice != 0 {
+		flag |= os.O_EXCL
+	} else if st.Mode().IsRegular() {
+		flag |= os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(device, flag, 0)
+	if errors.Is(err, syscall.EBUSY) {
+		return nil, nil, fmt.Errorf("%s is in use, unmount its partitions and close programs using it first", device)
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("failed to open device: %w", err)
+	}
+
+	return f, st, nil
+}
+
+// checkUnmounted fails if device or any of its partitions is mounted.
+func checkUnmounted(device string) error {
+	resolved, err := filepath.Abs(device)
+	if err == nil {
+		resolved, err = filepath.EvalSymlinks(resolved)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", device, err)
+	}
+
+	f, err := os.Open("/proc/self/mounts")
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open mounts: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		source, mountpoint, _ := strings.Cut(scanner.Text(), " ")
+		if isPartitionOf(source, resolved) {
+			mountpoint, _, _ = strings.Cut(mountpoint, " ")
+			return fmt.Errorf("%s is mounted at %s, unmount it first", source, mountpoint)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// isPartitionOf reports whether device is disk or one of its partitions, e.g.
+// /dev/sdb1 of /dev/sdb or /dev/mmcblk0p2 of /dev/mmcblk0.
+func isPartitionOf(device, disk string) bool {
+	rest, ok := strings.CutPrefix(device, disk)
+	if !ok {
+		return false
+	}
+	rest = strings.TrimPrefix(rest, "p")
+	return strings.Trim(rest, "0123456789") == ""
+}
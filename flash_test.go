@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBmapPath(t *testing.T) {
+	assert.Equal(t, "build/out.img.bmap", bmapPath("build/out.img"))
+	assert.Equal(t, "build/out.img.bmap", bmapPath("build/out.img.xz"))
+	assert.Equal(t, "elkpi.wic.bmap", bmapPath("elkpi.wic.bz2"))
+}
+
+func TestIsPartitionOf(t *testing.T) {
+	assert.True(t, isPartitionOf("/dev/sdb", "/dev/sdb"))
+	assert.True(t, isPartitionOf("/dev/sdb1", "/dev/sdb"))
+	assert.True(t, isPartitionOf("/dev/mmcblk0p2", "/dev/mmcblk0"))
+	assert.False(t, isPartitionOf("/dev/sdbc", "/dev/sdb"))
+	assert.False(t, isPartitionOf("devtmpfs", "dev"))
+	assert.False(t, isPartitionOf("/dev/sda1", "/dev/sdb"))
+}
+
+func TestDiskFlash(t *testing.T) {
+	dir := t.TempDir()
+	image := filepath.Join(dir, "out.img")
+
+	// a sparse image with data in its first and last blocks
+	data := make([]byte, 1<<20)
+	_, err := rand.Read(data[:4096])
+	require.NoError(t, err)
+	_, err = rand.Read(data[len(data)-4096:])
+	require.NoError(t, err)
+	f, err := os.Create(image)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(int64(len(data))))
+	_, err = f.WriteAt(data[:4096], 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt(data[len(data)-4096:], int64(len(data)-4096))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	bm, err := createBmap(image)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(bmapPath(image), bm, 0644))
+
+	_, err = compressFile(context.Background(), discardEvents, compression(image+".xz"), image, image+".xz")
+	require.NoError(t, err)
+
+	globals := &Globals{Output: "json"}
+	for _, cmd := range []DiskFlashCmd{
+		{Image: image, Bmap: true},
+		{Image: image + ".xz", Bmap: true},
+		{Image: image + ".xz"},
+	} {
+		// written before, e.g. with a bigger image
+		cmd.Device = filepath.Join(dir, "device")
+		require.NoError(t, os.WriteFile(cmd.Device, bytes.Repeat([]byte("old image"), len(data)/4), 0644))
+
+		require.NoError(t, cmd.Run(context.Background(), globals), cmd.Image)
+
+		got, err := os.ReadFile(cmd.Device)
+		require.NoError(t, err)
+		assert.Equal(t, data, got, cmd.Image)
+	}
+
+	cmd := DiskFlashCmd{Image: filepath.Join(dir, "other.img"), Device: filepath.Join(dir, "device"), Bmap: true}
+	assert.ErrorContains(t, cmd.Run(context.Background(), globals), "no bmap file found next to")
+}
@@ -0,0 +1,269 @@
+// Package bmap creates, reads and copies by the block maps of bmaptool. A
+// block map lists the blocks of a disk image that hold data, with their
+// checksums, so that flashing can skip the rest.
+package bmap
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// BlockSize is the block size of created block maps.
+const BlockSize = 4096
+
+// whence values of lseek that find the data and holes of sparse files
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+var checksums = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// Bmap is a block map of a disk image.
+type Bmap struct {
+	ImageSize    int64
+	BlockSize    int64
+	ChecksumType string
+	Ranges       []Range
+}
+
+// Range is a range of blocks that hold data, from First to Last inclusive.
+type Range struct {
+	First    int64
+	Last     int64
+	Checksum string
+}
+
+// BlocksCount returns the number of blocks of the image.
+func (b *Bmap) BlocksCount() int64 {
+	return (b.ImageSize + b.BlockSize - 1) / b.BlockSize
+}
+
+// MappedBlocksCount returns the number of blocks that hold data.
+func (b *Bmap) MappedBlocksCount() int64 {
+	var n int64
+	for _, r := range b.Ranges {
+		n += r.Last - r.First + 1
+	}
+	return n
+}
+
+// MappedSize returns the number of bytes that hold data.
+func (b *Bmap) MappedSize() int64 {
+	var n int64
+	for _, r := range b.Ranges {
+		n += b.rangeSize(r)
+	}
+	return n
+}
+
+// rangeSize returns the size of r in bytes. The last block of the image may
+// be partial.
+func (b *Bmap) rangeSize(r Range) int64 {
+	return min((r.Last+1)*b.BlockSize, b.ImageSize) - r.First*b.BlockSize
+}
+
+// Create maps the data of the sparse file f. Holes are left out of the map,
+// so f should have holes in place of its empty blocks.
+func Create(f *os.File) (*Bmap, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat: %w", err)
+	}
+
+	b := &Bmap{ImageSize: st.Size(), BlockSize: BlockSize, ChecksumType: "sha256"}
+
+	for off := int64(0); off < b.ImageSize; {
+		data, err := f.Seek(off, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// no data after off
+			break
+		} else if errors.Is(err, syscall.EINVAL) {
+			// no support for sparse files, everything is data
+			data = off
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to seek data: %w", err)
+		}
+
+		hole, err := f.Seek(data, seekHole)
+		if errors.Is(err, syscall.EINVAL) {
+			hole = b.ImageSize
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to seek hole: %w", err)
+		}
+
+		r := Range{First: data / BlockSize, Last: (hole - 1) / BlockSize}
+		if n := len(b.Ranges); n > 0 && b.Ranges[n-1].Last+1 >= r.First {
+			b.Ranges[n-1].Last = r.Last
+		} else {
+			b.Ranges = append(b.Ranges, r)
+		}
+		off = hole
+	}
+
+	for i, r := range b.Ranges {
+		h := sha256.New()
+		if _, err := io.Copy(h, io.NewSectionReader(f, r.First*BlockSize, b.rangeSize(r))); err != nil {
+			return nil, fmt.Errorf("failed to read blocks %d-%d: %w", r.First, r.Last, err)
+		}
+		b.Ranges[i].Checksum = hex.EncodeToString(h.Sum(nil))
+	}
+
+	return b, nil
+}
+
+type xmlBmap struct {
+	XMLName           xml.Name   `xml:"bmap"`
+	Version           string     `xml:"version,attr"`
+	ImageSize         int64      `xml:"ImageSize"`
+	BlockSize         int64      `xml:"BlockSize"`
+	BlocksCount       int64      `xml:"BlocksCount"`
+	MappedBlocksCount int64      `xml:"MappedBlocksCount"`
+	ChecksumType      string     `xml:"ChecksumType"`
+	BmapFileChecksum  string     `xml:"BmapFileChecksum"`
+	Ranges            []xmlRange `xml:"BlockMap>Range"`
+}
+
+type xmlRange struct {
+	Checksum string `xml:"chksum,attr"`
+	Blocks   string `xml:",chardata"`
+}
+
+// Marshal returns the block map in the XML format of bmaptool 2.0.
+func (b *Bmap) Marshal() ([]byte, error) {
+	newHash, ok := checksums[b.ChecksumType]
+	if !ok {
+		return nil, fmt.Errorf("unknown checksum type %q", b.ChecksumType)
+	}
+
+	x := xmlBmap{
+		Version:           "2.0",
+		ImageSize:         b.ImageSize,
+		BlockSize:         b.BlockSize,
+		BlocksCount:       b.BlocksCount(),
+		MappedBlocksCount: b.MappedBlocksCount(),
+		ChecksumType:      b.ChecksumType,
+		// the checksum of the file is calculated with zeros in its place
+		BmapFileChecksum: strings.Repeat("0", newHash().Size()*2),
+	}
+	for _, r := range b.Ranges {
+		blocks := strconv.FormatInt(r.First, 10)
+		if r.Last != r.First {
+			blocks += "-" + strconv.FormatInt(r.Last, 10)
+		}
+		x.Ranges = append(x.Ranges, xmlRange{Checksum: r.Checksum, Blocks: blocks})
+	}
+
+	data, err := xml.MarshalIndent(x, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	data = append([]byte(xml.Header), append(data, '\n')...)
+
+	h := newHash()
+	h.Write(data)
+	sum := hex.EncodeToString(h.Sum(nil))
+	return bytes.Replace(data, []byte(x.BmapFileChecksum), []byte(sum), 1), nil
+}
+
+// Parse parses a block map in the XML format of bmaptool 2.x and verifies its
+// checksum.
+func Parse(data []byte) (*Bmap, error) {
+	var x xmlBmap
+	if err := xml.Unmarshal(data, &x); err != nil {
+		return nil, fmt.Errorf("failed to parse bmap: %w", err)
+	}
+
+	if major, _, _ := strings.Cut(x.Version, "."); major != "2" {
+		return nil, fmt.Errorf("unsupported bmap version %q, expected 2.x", x.Version)
+	}
+
+	b := &Bmap{
+		ImageSize:    x.ImageSize,
+		BlockSize:    x.BlockSize,
+		ChecksumType: strings.TrimSpace(x.ChecksumType),
+	}
+
+	newHash, ok := checksums[b.ChecksumType]
+	if !ok {
+		return nil, fmt.Errorf("unknown checksum type %q", b.ChecksumType)
+	}
+
+	if b.BlockSize <= 0 || b.ImageSize < 0 {
+		return nil, fmt.Errorf("invalid block size %d or image size %d", b.BlockSize, b.ImageSize)
+	}
+
+	sum := strings.TrimSpace(x.BmapFileChecksum)
+	h := newHash()
+	h.Write(bytes.Replace(data, []byte(sum), []byte(strings.Repeat("0", len(sum))), 1))
+	if !strings.EqualFold(sum, hex.EncodeToString(h.Sum(nil))) {
+		return nil, fmt.Errorf("bmap file checksum mismatch, the file is corrupted")
+	}
+
+	for _, xr := range x.Ranges {
+		first, last, isRange := strings.Cut(strings.TrimSpace(xr.Blocks), "-")
+		if !isRange {
+			last = first
+		}
+
+		r := Range{Checksum: xr.Checksum}
+		var err1, err2 error
+		r.First, err1 = strconv.ParseInt(first, 10, 64)
+		r.Last, err2 = strconv.ParseInt(last, 10, 64)
+		if err := errors.Join(err1, err2); err != nil || r.First < 0 || r.Last < r.First || r.Last >= b.BlocksCount() {
+			return nil, fmt.Errorf("invalid block range %q", xr.Blocks)
+		}
+		if n := len(b.Ranges); n > 0 && r.First <= b.Ranges[n-1].Last {
+			return nil, fmt.Errorf("block range %q overlaps or is out of order", xr.Blocks)
+		}
+
+		b.Ranges = append(b.Ranges, r)
+	}
+
+	return b, nil
+}
+
+// Copy writes the mapped blocks of the image read from src to dst, and
+// verifies their checksums. Blocks that aren't mapped are read and skipped.
+func (b *Bmap) Copy(dst io.WriterAt, src io.Reader) error {
+	newHash, ok := checksums[b.ChecksumType]
+	if !ok {
+		return fmt.Errorf("unknown checksum type %q", b.ChecksumType)
+	}
+
+	var off int64
+	for _, r := range b.Ranges {
+		start := r.First * b.BlockSize
+		if _, err := io.CopyN(io.Discard, src, start-off); err != nil {
+			return fmt.Errorf("failed to read image: %w", err)
+		}
+
+		h := newHash()
+		w := io.MultiWriter(io.NewOffsetWriter(dst, start), h)
+		if _, err := io.CopyN(w, src, b.rangeSize(r)); err != nil {
+			return fmt.Errorf("failed to copy blocks %d-%d: %w", r.First, r.Last, err)
+		}
+
+		if sum := hex.EncodeToString(h.Sum(nil)); r.Checksum != "" && !strings.EqualFold(sum, r.Checksum) {
+			return fmt.Errorf("checksum mismatch of blocks %d-%d, the image doesn't match the bmap", r.First, r.Last)
+		}
+
+		off = start + b.rangeSize(r)
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package bmap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sum(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func TestCreate(t *testing.T) {
+	// data in blocks 1, 2 and 10, the last one partial
+	data := make([]byte, 10*BlockSize+100)
+	_, err := rand.Read(data[BlockSize : 3*BlockSize])
+	require.NoError(t, err)
+	_, err = rand.Read(data[10*BlockSize:])
+	require.NoError(t, err)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "image.img"))
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, f.Truncate(int64(len(data))))
+	_, err = f.WriteAt(data[BlockSize:3*BlockSize], BlockSize)
+	require.NoError(t, err)
+	_, err = f.WriteAt(data[10*BlockSize:], 10*BlockSize)
+	require.NoError(t, err)
+
+	b, err := Create(f)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), b.ImageSize)
+	assert.Equal(t, int64(11), b.BlocksCount())
+
+	// filesystems without holes map everything
+	if len(b.Ranges) == 1 {
+		t.Skip("no sparse file support")
+	}
+	assert.Equal(t, []Range{
+		{First: 1, Last: 2, Checksum: sum(data[BlockSize : 3*BlockSize])},
+		{First: 10, Last: 10, Checksum: sum(data[10*BlockSize:])},
+	}, b.Ranges)
+	assert.Equal(t, int64(3), b.MappedBlocksCount())
+	assert.Equal(t, int64(2*BlockSize+100), b.MappedSize())
+
+	var out bytes.Buffer
+	w := &writerAt{&out}
+	require.NoError(t, b.Copy(w, bytes.NewReader(data)))
+	assert.Equal(t, data, out.Bytes())
+
+	data[2*BlockSize] ^= 1
+	assert.EqualError(t, b.Copy(w, bytes.NewReader(data)), "checksum mismatch of blocks 1-2, the image doesn't match the bmap")
+}
+
+func TestMarshalParse(t *testing.T) {
+	b := &Bmap{
+		ImageSize:    10*BlockSize + 100,
+		BlockSize:    BlockSize,
+		ChecksumType: "sha256",
+		Ranges: []Range{
+			{First: 1, Last: 2, Checksum: sum([]byte("a"))},
+			{First: 10, Last: 10, Checksum: sum([]byte("b"))},
+		},
+	}
+
+	data, err := b.Marshal()
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "<MappedBlocksCount>3</MappedBlocksCount>")
+	assert.Contains(t, string(data), `<Range chksum="`+sum([]byte("a"))+`">1-2</Range>`)
+	assert.Contains(t, string(data), `<Range chksum="`+sum([]byte("b"))+`">10</Range>`)
+
+	parsed, err := Parse(data)
+	require.NoError(t, err)
+	assert.Equal(t, b, parsed)
+
+	_, err = Parse(bytes.Replace(data, []byte(">1-2<"), []byte(">1-3<"), 1))
+	assert.EqualError(t, err, "bmap file checksum mismatch, the file is corrupted")
+}
+
+func TestParseBmaptool(t *testing.T) {
+	// as written by bmaptool create, with whitespace around values
+	data := []byte(`<?xml version="1.0" ?>
+<bmap version="2.0">
+    <ImageSize> 16384 </ImageSize>
+    <BlockSize> 4096 </BlockSize>
+    <BlocksCount> 4 </BlocksCount>
+    <MappedBlocksCount> 2 </MappedBlocksCount>
+    <ChecksumType> sha256 </ChecksumType>
+    <BmapFileChecksum> 0000000000000000000000000000000000000000000000000000000000000000 </BmapFileChecksum>
+    <BlockMap>
+        <Range chksum="` + sum([]byte("a")) + `"> 0 </Range>
+        <Range chksum="` + sum([]byte("b")) + `"> 2 </Range>
+    </BlockMap>
+</bmap>
+`)
+	data = bytes.Replace(data, []byte(strings.Repeat("0", 64)), []byte(sum(data)), 1)
+
+	b, err := Parse(data)
+	require.NoError(t, err)
+	assert.Equal(t, int64(16384), b.ImageSize)
+	assert.Equal(t, []Range{
+		{First: 0, Last: 0, Checksum: sum([]byte("a"))},
+		{First: 2, Last: 2, Checksum: sum([]byte("b"))},
+	}, b.Ranges)
+
+	_, err = Parse([]byte(`<bmap version="1.4"></bmap>`))
+	assert.EqualError(t, err, `unsupported bmap version "1.4", expected 2.x`)
+}
+
+// writerAt writes to a buffer at offsets, growing it as needed.
+type writerAt struct {
+	buf *bytes.Buffer
+}
+
+func (w *writerAt) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > w.buf.Len() {
+		w.buf.Write(make([]byte, end-w.buf.Len()))
+	}
+	copy(w.buf.Bytes()[off:], p)
+	return len(p), nil
+}
@@ -0,0 +1,370 @@
+// Package cache stores downloaded source images so that builds can reuse them
+// instead of downloading them again.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gaboose/pipod/internal/sparse"
+)
+
+const (
+	metaFile   = "meta.json"
+	sourceFile = "source"
+	imageFile  = "image"
+)
+
+// Cache is a directory of source image entries.
+type Cache struct {
+	Dir string
+}
+
+// Default returns the cache in $XDG_CACHE_HOME/pipod.
+func Default() (*Cache, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find user cache dir: %w", err)
+	}
+
+	return New(filepath.Join(dir, "pipod")), nil
+}
+
+func New(dir string) *Cache {
+	return &Cache{Dir: dir}
+}
+
+// KeySHA256 returns the key of a source image with a known sha256 hash.
+func KeySHA256(sum string) string {
+	return "sha256-" + strings.ToLower(sum)
+}
+
+// KeyURL returns the key of a source image without a known hash. The ETag
+// makes sure that a changed upstream file is not served from the cache.
+func KeyURL(url string, etag string) string {
+	sum := sha256.Sum256([]byte(url + "\n" + etag))
+	return "url-" + hex.EncodeToString(sum[:])
+}
+
+// Meta describes a cache entry.
+type Meta struct {
+	URL       string    `json:"url"`
+	ETag      string    `json:"etag,omitempty"`
+	SHA256    string    `json:"sha256"`
+	Size      int64     `json:"size"`
+	ImageSize int64     `json:"imageSize"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"lastUsed"`
+}
+
+// Entry is a cached source image. It holds the source file as downloaded and
+// the decompressed disk image.
+type Entry struct {
+	Key  string
+	Dir  string
+	Meta Meta
+
+	lock *os.File
+}
+
+// Entry returns the entry for key. The entry does not have to exist yet.
+func (c *Cache) Entry(key string) (*Entry, error) {
+	e := &Entry{
+		Key: key,
+		Dir: filepath.Join(c.Dir, key),
+	}
+
+	if err := e.readMeta(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (e *Entry) readMeta() error {
+	e.Meta = Meta{}
+
+	bts, err := os.ReadFile(e.metaPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read %s: %w", e.metaPath(), err)
+	}
+
+	if err := json.Unmarshal(bts, &e.Meta); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", e.metaPath(), err)
+	}
+
+	return nil
+}
+
+// List returns all entries sorted by last use, most recent first. Entries
+// without metadata are incomplete downloads.
+func (c *Cache) List() ([]*Entry, error) {
+	dirEntries, err := os.ReadDir(c.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read cache dir: %w", err)
+	}
+
+	var entries []*Entry
+	for _, de := range dirEntries {
+		if !de.IsDir() {
+			continue
+		}
+
+		e, err := c.Entry(de.Name())
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Meta.LastUsed.After(entries[j].Meta.LastUsed)
+	})
+
+	return entries, nil
+}
+
+func (e *Entry) metaPath() string { return filepath.Join(e.Dir, metaFile) }
+
+// lockPath is next to the entry directory, so that removing the entry doesn't
+// let another process lock it while it is locked. Lock files are never
+// removed for the same reason.
+func (e *Entry) lockPath() string { return e.Dir + ".lock" }
+
+// Lock locks the entry against other processes until Unlock, exclusively to
+// fill or remove it and shared to read it. Locking a locked entry converts
+// the lock. The metadata is read again once the lock is taken, as another
+// process may have changed it.
+func (e *Entry) Lock(exclusive bool) error {
+	_, err := e.lockWith(exclusive, true)
+	return err
+}
+
+// TryLock locks the entry exclusively unless another process has it locked.
+func (e *Entry) TryLock() (bool, error) {
+	return e.lockWith(true, false)
+}
+
+func (e *Entry) lockWith(exclusive, wait bool) (bool, error) {
+	if e.lock == nil {
+		if err := os.MkdirAll(filepath.Dir(e.Dir), 0755); err != nil {
+			return false, fmt.Errorf("failed to create %s: %w", filepath.Dir(e.Dir), err)
+		}
+
+		f, err := os.OpenFile(e.lockPath(), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return false, fmt.Errorf("failed to open %s: %w", e.lockPath(), err)
+		}
+		e.lock = f
+	}
+
+	locked, err := flock(e.lock, exclusive, wait)
+	if err != nil {
+		return false, fmt.Errorf("failed to lock %s: %w", e.lockPath(), err)
+	} else if !locked {
+		return false, nil
+	}
+
+	return true, e.readMeta()
+}
+
+// Unlock releases the lock of the entry, if any.
+func (e *Entry) Unlock() error {
+	if e.lock == nil {
+		return nil
+	}
+
+	err := funlock(e.lock)
+	e.lock.Close()
+	e.lock = nil
+	return err
+}
+
+// SourcePath is the path of the source file as downloaded.
+func (e *Entry) SourcePath() string { return filepath.Join(e.Dir, sourceFile) }
+
+// ImagePath is the path of the decompressed disk image. It must be treated as
+// read-only, use CloneImage to get a writable copy.
+func (e *Entry) ImagePath() string { return filepath.Join(e.Dir, imageFile) }
+
+// Complete reports whether both files of the entry were fully written.
+func (e *Entry) Complete() bool {
+	if e.Meta.Created.IsZero() {
+		return false
+	}
+
+	for _, path := range []string{e.SourcePath(), e.ImagePath()} {
+		if _, err := os.Stat(path); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Prepare creates the entry directory and removes the files left from a
+// previous incomplete build of the entry. Source files are kept so that the
+// download can be skipped or resumed.
+func (e *Entry) Prepare() error {
+	if err := os.MkdirAll(e.Dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", e.Dir, err)
+	}
+
+	parts, err := filepath.Glob(filepath.Join(e.Dir, metaFile+".*.part"))
+	if err != nil {
+		return fmt.Errorf("failed to find metadata files: %w", err)
+	}
+
+	for _, path := range append([]string{e.metaPath(), e.ImagePath(), e.ImagePath() + ".part"}, parts...) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+
+	e.Meta = Meta{}
+	return nil
+}
+
+// Commit marks the entry as complete by writing its metadata.
+func (e *Entry) Commit(meta Meta) error {
+	now := time.Now()
+	meta.Created = now
+	meta.LastUsed = now
+	e.Meta = meta
+	return e.writeMeta()
+}
+
+// Touch updates the last use time of the entry.
+func (e *Entry) Touch() error {
+	e.Meta.LastUsed = time.Now()
+	return e.writeMeta()
+}
+
+func (e *Entry) writeMeta() error {
+	bts, err := json.MarshalIndent(e.Meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+
+	// readers of the entry may touch it at the same time
+	f, err := os.CreateTemp(e.Dir, metaFile+".*.part")
+	if err != nil {
+		return fmt.Errorf("failed to create metadata file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(bts)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", f.Name(), err)
+	}
+
+	if err := os.Rename(f.Name(), e.metaPath()); err != nil {
+		return fmt.Errorf("failed to rename %s: %w", f.Name(), err)
+	}
+
+	return nil
+}
+
+// Remove deletes the entry from disk. The entry should be locked
+// exclusively.
+func (e *Entry) Remove() error {
+	return os.RemoveAll(e.Dir)
+}
+
+// Size returns the total size of the entry files.
+func (e *Entry) Size() (int64, error) {
+	var size int64
+	err := filepath.Walk(e.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// Verify checks the entry files against its metadata and key.
+func (e *Entry) Verify() error {
+	if !e.Complete() {
+		return errors.New("incomplete entry")
+	}
+
+	f, err := os.Open(e.SourcePath())
+	if err != nil {
+		return fmt.Errorf("failed to open source: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return fmt.Errorf("failed to read source: %w", err)
+	}
+
+	got := hex.EncodeToString(h.Sum(nil))
+	if got != e.Meta.SHA256 {
+		return fmt.Errorf("source checksum mismatch: got %s, want %s", got, e.Meta.SHA256)
+	}
+	if strings.HasPrefix(e.Key, "sha256-") && KeySHA256(got) != e.Key {
+		return fmt.Errorf("source checksum mismatch: got %s, want %s", got, strings.TrimPrefix(e.Key, "sha256-"))
+	}
+	if n != e.Meta.Size {
+		return fmt.Errorf("source size mismatch: got %d, want %d", n, e.Meta.Size)
+	}
+
+	st, err := os.Stat(e.ImagePath())
+	if err != nil {
+		return fmt.Errorf("failed to stat image: %w", err)
+	}
+	if st.Size() != e.Meta.ImageSize {
+		return fmt.Errorf("image size mismatch: got %d, want %d", st.Size(), e.Meta.ImageSize)
+	}
+
+	return nil
+}
+
+// CloneImage writes a copy of the image to dest. The copy is a reflink where
+// the filesystem supports it and a sparse copy otherwise.
+func (e *Entry) CloneImage(dest string) error {
+	src, err := os.Open(e.ImagePath())
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", e.ImagePath(), err)
+	}
+	defer src.Close()
+
+	dst, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", dest, err)
+	}
+	defer dst.Close()
+
+	if err := reflink(dst, src); err == nil {
+		return dst.Close()
+	}
+
+	if _, err := sparse.Copy(dst, src); err != nil {
+		return fmt.Errorf("failed to copy to %s: %w", dest, err)
+	}
+
+	return dst.Close()
+}
@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntry(t *testing.T) {
+	c := New(t.TempDir())
+	source := []byte("compressed")
+	image := []byte("decompressed")
+	sum := sha256.Sum256(source)
+	sumHex := hex.EncodeToString(sum[:])
+
+	e, err := c.Entry(KeySHA256(sumHex))
+	require.NoError(t, err)
+	assert.False(t, e.Complete())
+
+	require.NoError(t, e.Prepare())
+	require.NoError(t, os.WriteFile(e.SourcePath(), source, 0644))
+	require.NoError(t, os.WriteFile(e.ImagePath(), image, 0644))
+	assert.False(t, e.Complete())
+
+	require.NoError(t, e.Commit(Meta{
+		URL:       "https://example.com/image.img.xz",
+		SHA256:    sumHex,
+		Size:      int64(len(source)),
+		ImageSize: int64(len(image)),
+	}))
+	assert.True(t, e.Complete())
+	assert.NoError(t, e.Verify())
+
+	entries, err := c.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, e.Key, entries[0].Key)
+	assert.Equal(t, "https://example.com/image.img.xz", entries[0].Meta.URL)
+
+	dest := filepath.Join(t.TempDir(), "out.img")
+	require.NoError(t, e.CloneImage(dest))
+	bts, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, image, bts)
+
+	require.NoError(t, os.WriteFile(e.SourcePath(), []byte("corrupted"), 0644))
+	assert.ErrorContains(t, e.Verify(), "checksum mismatch")
+
+	require.NoError(t, e.Remove())
+	entries, err = c.List()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestLock(t *testing.T) {
+	c := New(t.TempDir())
+	reader, err := c.Entry("url-test")
+	require.NoError(t, err)
+	require.NoError(t, reader.Lock(false))
+
+	other, err := c.Entry("url-test")
+	require.NoError(t, err)
+	locked, err := other.TryLock()
+	require.NoError(t, err)
+	assert.False(t, locked)
+
+	// readers share the lock
+	require.NoError(t, other.Lock(false))
+	require.NoError(t, other.Unlock())
+
+	require.NoError(t, reader.Unlock())
+	locked, err = other.TryLock()
+	require.NoError(t, err)
+	assert.True(t, locked)
+
+	// the metadata is read again once locked
+	require.NoError(t, other.Prepare())
+	require.NoError(t, os.WriteFile(other.SourcePath(), nil, 0644))
+	require.NoError(t, os.WriteFile(other.ImagePath(), nil, 0644))
+	require.NoError(t, other.Commit(Meta{URL: "https://example.com/image.img"}))
+	require.NoError(t, other.Unlock())
+
+	assert.False(t, reader.Complete())
+	require.NoError(t, reader.Lock(false))
+	assert.True(t, reader.Complete())
+	assert.Equal(t, "https://example.com/image.img", reader.Meta.URL)
+	require.NoError(t, reader.Unlock())
+}
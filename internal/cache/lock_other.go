@@ -0,0 +1,13 @@
+//go:build !unix
+
+package cache
+
+import "os"
+
+func flock(f *os.File, exclusive, wait bool) (bool, error) {
+	return true, nil
+}
+
+func funlock(f *os.File) error {
+	return nil
+}
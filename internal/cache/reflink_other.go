@@ -0,0 +1,12 @@
+//go:build !linux
+
+package cache
+
+import (
+	"errors"
+	"os"
+)
+
+func reflink(dst *os.File, src *os.File) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,171 @@
+package download
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ClientConfig configures the HTTP client of downloads. It holds no secrets:
+// credentials are looked up per request host, from the environment and the
+// netrc file.
+type ClientConfig struct {
+	// Proxy is the URL of the proxy for all requests. If empty, the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are used.
+	Proxy string
+	// CABundle is a PEM file of certificates to trust in addition to the
+	// system ones.
+	CABundle string
+	// Headers are extra request headers by host or host:port. Environment
+	// variables in values are expanded, so that secrets can stay out of the
+	// configuration.
+	Headers map[string]map[string]string
+	// Netrc is the path of the netrc file. $NETRC or ~/.netrc if empty.
+	Netrc string
+}
+
+// NewClient returns an HTTP client configured by cfg. Requests to https URLs
+// are authenticated with, in order of precedence:
+//
+//   - a bearer token from $PIPOD_TOKEN_<HOST>
+//   - basic auth from $PIPOD_BASIC_AUTH_<HOST> formatted as user:password
+//   - basic auth from the netrc file
+//
+// where <HOST> is the upper case host name with all other characters than
+// letters and digits replaced by underscores, e.g. PIPOD_TOKEN_GITHUB_COM.
+// Credentials are looked up for every request, so they are not sent along
+// when a server redirects to another host.
+func NewClient(cfg ClientConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.Proxy != "" {
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url %s: %w", cfg.Proxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if cfg.CABundle != "" {
+		pool, err := certPool(cfg.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	netrcPath := cfg.Netrc
+	if netrcPath == "" {
+		netrcPath = defaultNetrcPath()
+	}
+	netrc, err := readNetrc(netrcPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{
+		Transport: &authTransport{
+			base:    transport,
+			headers: cfg.Headers,
+			netrc:   netrc,
+		},
+	}, nil
+}
+
+func certPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ca bundle: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return pool, nil
+}
+
+func defaultNetrcPath() string {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// authTransport adds the headers and credentials of the request host.
+type authTransport struct {
+	base    http.RoundTripper
+	headers map[string]map[string]string
+	netrc   []netrcMachine
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request it was given
+	req = req.Clone(req.Context())
+
+	// headers and credentials are never sent in the clear
+	if req.URL.Scheme != "https" {
+		return t.base.RoundTrip(req)
+	}
+
+	headers, ok := t.headers[req.URL.Host]
+	if !ok {
+		headers = t.headers[req.URL.Hostname()]
+	}
+	for k, v := range headers {
+		req.Header.Set(k, os.ExpandEnv(v))
+	}
+
+	if req.Header.Get("Authorization") == "" {
+		t.authorize(req)
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+func (t *authTransport) authorize(req *http.Request) {
+	host := envHost(req.URL.Hostname())
+
+	if token := os.Getenv("PIPOD_TOKEN_" + host); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return
+	}
+
+	if userPass := os.Getenv("PIPOD_BASIC_AUTH_" + host); userPass != "" {
+		user, pass, _ := strings.Cut(userPass, ":")
+		req.SetBasicAuth(user, pass)
+		return
+	}
+
+	if m, ok := lookupNetrc(t.netrc, req.URL.Hostname()); ok {
+		req.SetBasicAuth(m.login, m.password)
+	}
+}
+
+func envHost(host string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, host)
+}
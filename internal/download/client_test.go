@@ -0,0 +1,191 @@
+package download
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCABundle writes the certificate of srv to a PEM file.
+func writeCABundle(t *testing.T, srv *httptest.Server) string {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	require.NoError(t, os.WriteFile(path, data, 0644))
+	return path
+}
+
+func fetchString(t *testing.T, client *http.Client, rawURL string) (string, error) {
+	dest := filepath.Join(t.TempDir(), "dest")
+	if err := NewWithClient(client).Fetch(context.Background(), rawURL, dest); err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	return string(data), nil
+}
+
+func TestClientCABundle(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("disk image"))
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(ClientConfig{Netrc: "/nonexistent"})
+	require.NoError(t, err)
+	h := NewHTTP()
+	h.Client = client
+	_, err = h.ETag(context.Background(), mustParse(t, srv.URL))
+	assert.ErrorContains(t, err, "certificate")
+
+	client, err = NewClient(ClientConfig{CABundle: writeCABundle(t, srv), Netrc: "/nonexistent"})
+	require.NoError(t, err)
+	got, err := fetchString(t, client, srv.URL+"/image.img")
+	require.NoError(t, err)
+	assert.Equal(t, "disk image", got)
+
+	_, err = NewClient(ClientConfig{CABundle: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.Error(t, err)
+}
+
+func TestClientAuth(t *testing.T) {
+	var gotAuth, gotHeader string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth, gotHeader = r.Header.Get("Authorization"), r.Header.Get("X-Api-Key")
+		w.Write([]byte("disk image"))
+	}))
+	defer srv.Close()
+	host := mustParse(t, srv.URL).Host
+
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	require.NoError(t, os.WriteFile(netrc, []byte("machine 127.0.0.1\n  login netrcuser\n  password netrcpass\n"), 0600))
+
+	newClient := func(headers map[string]map[string]string) *http.Client {
+		client, err := NewClient(ClientConfig{CABundle: writeCABundle(t, srv), Netrc: netrc, Headers: headers})
+		require.NoError(t, err)
+		return client
+	}
+
+	t.Run("netrc", func(t *testing.T) {
+		_, err := fetchString(t, newClient(nil), srv.URL)
+		require.NoError(t, err)
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth("netrcuser", "netrcpass")
+		assert.Equal(t, req.Header.Get("Authorization"), gotAuth)
+	})
+
+	t.Run("basic auth env", func(t *testing.T) {
+		t.Setenv("PIPOD_BASIC_AUTH_127_0_0_1", "envuser:envpass")
+		_, err := fetchString(t, newClient(nil), srv.URL)
+		require.NoError(t, err)
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth("envuser", "envpass")
+		assert.Equal(t, req.Header.Get("Authorization"), gotAuth)
+	})
+
+	t.Run("token env", func(t *testing.T) {
+		t.Setenv("PIPOD_BASIC_AUTH_127_0_0_1", "envuser:envpass")
+		t.Setenv("PIPOD_TOKEN_127_0_0_1", "secret")
+		_, err := fetchString(t, newClient(nil), srv.URL)
+		require.NoError(t, err)
+		assert.Equal(t, "Bearer secret", gotAuth)
+	})
+
+	t.Run("headers", func(t *testing.T) {
+		t.Setenv("TEST_API_KEY", "key")
+		t.Setenv("PIPOD_TOKEN_127_0_0_1", "secret")
+		_, err := fetchString(t, newClient(map[string]map[string]string{
+			host: {"X-Api-Key": "${TEST_API_KEY}", "Authorization": "token other"},
+		}), srv.URL)
+		require.NoError(t, err)
+		assert.Equal(t, "key", gotHeader)
+		assert.Equal(t, "token other", gotAuth)
+	})
+
+	t.Run("other host", func(t *testing.T) {
+		_, err := fetchString(t, newClient(map[string]map[string]string{
+			"127.0.0.1:1": {"X-Api-Key": "key"},
+		}), srv.URL)
+		require.NoError(t, err)
+		assert.Empty(t, gotHeader)
+	})
+}
+
+func TestClientNoCredentialsOverHTTP(t *testing.T) {
+	t.Setenv("PIPOD_TOKEN_127_0_0_1", "secret")
+
+	var gotAuth, gotHeader string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth, gotHeader = r.Header.Get("Authorization"), r.Header.Get("X-Api-Key")
+		w.Write([]byte("disk image"))
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(ClientConfig{Netrc: "/nonexistent", Headers: map[string]map[string]string{
+		"127.0.0.1": {"Authorization": "Bearer configured", "X-Api-Key": "key"},
+	}})
+	require.NoError(t, err)
+	_, err = fetchString(t, client, srv.URL)
+	require.NoError(t, err)
+	assert.Empty(t, gotAuth)
+	assert.Empty(t, gotHeader)
+}
+
+func TestClientProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Write([]byte("disk image"))
+	}))
+	defer proxy.Close()
+
+	client, err := NewClient(ClientConfig{Proxy: proxy.URL, Netrc: "/nonexistent"})
+	require.NoError(t, err)
+	got, err := fetchString(t, client, "http://images.invalid/image.img")
+	require.NoError(t, err)
+	assert.Equal(t, "disk image", got)
+	assert.Equal(t, "http://images.invalid/image.img", proxied)
+}
+
+func TestParseNetrc(t *testing.T) {
+	machines := parseNetrc(`machine example.com login alice password one
+macdef init
+cd /pub
+login mallory
+
+machine other.com
+	login bob
+	account acct
+	password two
+default login anonymous password guest
+`)
+
+	m, ok := lookupNetrc(machines, "example.com")
+	require.True(t, ok)
+	assert.Equal(t, netrcMachine{name: "example.com", login: "alice", password: "one"}, m)
+
+	m, ok = lookupNetrc(machines, "other.com")
+	require.True(t, ok)
+	assert.Equal(t, netrcMachine{name: "other.com", login: "bob", password: "two"}, m)
+
+	m, ok = lookupNetrc(machines, "unknown.com")
+	require.True(t, ok)
+	assert.Equal(t, netrcMachine{login: "anonymous", password: "guest"}, m)
+
+	_, ok = lookupNetrc(parseNetrc("machine example.com login alice password one"), "unknown.com")
+	assert.False(t, ok)
+}
+
+func mustParse(t *testing.T, rawURL string) *url.URL {
+	u, err := url.Parse(rawURL)
+	require.NoError(t, err)
+	return u
+}
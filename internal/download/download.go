@@ -0,0 +1,210 @@
+// Package download fetches source files. Files are fetched by a transport
+// registered for the scheme of their URL.
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/gaboose/pipod/internal/iio"
+)
+
+// Progress is called as bytes are written. Total is 0 when the size is
+// unknown. It is an alias so that transports can implement Transport without
+// importing this package.
+type Progress = func(current, total int64)
+
+// Log is called with messages about failed attempts that are retried. Like
+// Progress, it is an alias so that transports needn't import this package.
+type Log = func(format string, args ...any)
+
+// Transport fetches files of a URL scheme.
+type Transport interface {
+	// ETag returns a validator that changes whenever the file at u changes.
+	ETag(ctx context.Context, u *url.URL) (string, error)
+
+	// Fetch writes the file at u to dest. It must not leave a partial file
+	// at dest.
+	Fetch(ctx context.Context, u *url.URL, dest string, progress Progress) error
+}
+
+// Downloader dispatches downloads to transports by URL scheme.
+type Downloader struct {
+	// Progress, if set, is called as bytes are written.
+	Progress Progress
+	// Log, if set, is called when a download is retried or falls back to
+	// the next url.
+	Log Log
+
+	transports map[string]Transport
+}
+
+// New returns a downloader with the http, https and file transports
+// registered.
+func New() *Downloader {
+	return NewWithClient(http.DefaultClient)
+}
+
+// NewWithClient is like New but makes http and https requests with client.
+func NewWithClient(client *http.Client) *Downloader {
+	h := NewHTTP()
+	h.Client = client
+
+	d := &Downloader{transports: map[string]Transport{}}
+	h.Log = d.log
+	d.Register("http", h)
+	d.Register("https", h)
+	d.Register("file", File{})
+	return d
+}
+
+// Register makes t handle URLs of scheme, replacing any previous transport.
+func (d *Downloader) Register(scheme string, t Transport) {
+	d.transports[scheme] = t
+}
+
+func (d *Downloader) ETag(ctx context.Context, rawURL string) (string, error) {
+	t, u, err := d.transport(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	return t.ETag(ctx, u)
+}
+
+func (d *Downloader) Fetch(ctx context.Context, rawURL string, dest string) error {
+	t, u, err := d.transport(rawURL)
+	if err != nil {
+		return err
+	}
+
+	progress := d.Progress
+	if progress == nil {
+		progress = func(current, total int64) {}
+	}
+
+	return t.Fetch(ctx, u, dest, progress)
+}
+
+// ReadFile fetches a small file, such as a checksum file or a signature, into
+// memory.
+func (d *Downloader) ReadFile(ctx context.Context, rawURL string) ([]byte, error) {
+	t, u, err := d.transport(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "pipod-download-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dest := filepath.Join(dir, "file")
+	if err := t.Fetch(ctx, u, dest, func(current, total int64) {}); err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(dest)
+}
+
+// ETagFirst returns the ETag from the first of urls that answers.
+func (d *Downloader) ETagFirst(ctx context.Context, urls []string) (string, error) {
+	var errs []error
+	for _, rawURL := range urls {
+		etag, err := d.ETag(ctx, rawURL)
+		if err == nil {
+			return etag, nil
+		} else if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", rawURL, err))
+	}
+	return "", errors.Join(errs...)
+}
+
+// FetchFirst tries urls in order until one is fetched and returns it. A
+// partial download left by a failed url is resumed from the next, so all urls
+// must serve the same file.
+func (d *Downloader) FetchFirst(ctx context.Context, urls []string, dest string) (string, error) {
+	var errs []error
+	for i, rawURL := range urls {
+		err := d.Fetch(ctx, rawURL, dest)
+		if err == nil {
+			return rawURL, nil
+		} else if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+
+		errs = append(errs, fmt.Errorf("%s: %w", rawURL, err))
+		if i+1 < len(urls) {
+			d.log("%s: %v, trying %s", rawURL, err, urls[i+1])
+		}
+	}
+	return "", errors.Join(errs...)
+}
+
+func (d *Downloader) log(format string, args ...any) {
+	if d.Log != nil {
+		d.Log(format, args...)
+	}
+}
+
+func (d *Downloader) transport(rawURL string) (Transport, *url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse url %s: %w", rawURL, err)
+	}
+
+	if u.Scheme == "" {
+		u = fileURL(rawURL)
+	}
+
+	t, ok := d.transports[u.Scheme]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported url scheme %q", u.Scheme)
+	}
+
+	return t, u, nil
+}
+
+// Resolve turns a plain path into a file URL, resolving relative paths
+// against dir. URLs with a scheme are returned unchanged.
+func Resolve(rawURL string, dir string) string {
+	if u, err := url.Parse(rawURL); err == nil && u.Scheme != "" {
+		return rawURL
+	}
+
+	path := rawURL
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	return fileURL(path).String()
+}
+
+func fileURL(path string) *url.URL {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return &url.URL{Scheme: "file", Path: filepath.ToSlash(path)}
+}
+
+// progressWriter reports the bytes written to w, starting at offset.
+func progressWriter(w io.Writer, offset int64, total int64, progress Progress) io.Writer {
+	current := offset
+	progress(current, total)
+
+	return iio.Writer(func(p []byte) (int, error) {
+		n, err := w.Write(p)
+		current += int64(n)
+		progress(current, total)
+		return n, err
+	})
+}
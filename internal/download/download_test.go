@@ -0,0 +1,79 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolve(t *testing.T) {
+	assert.Equal(t, "https://example.com/a.img.xz", Resolve("https://example.com/a.img.xz", "/specs"))
+	assert.Equal(t, "oci://ghcr.io/gaboose/image:1.0", Resolve("oci://ghcr.io/gaboose/image:1.0", "/specs"))
+	assert.Equal(t, "file:///srv/images/a.img.xz", Resolve("file:///srv/images/a.img.xz", "/specs"))
+	assert.Equal(t, "file:///srv/images/a.img.xz", Resolve("/srv/images/a.img.xz", "/specs"))
+	assert.Equal(t, "file:///specs/images/a.img.xz", Resolve("images/a.img.xz", "/specs"))
+	assert.Equal(t, "file:///images/a.img.xz", Resolve("../images/a.img.xz", "/specs"))
+}
+
+func TestFetchFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "source.img")
+	require.NoError(t, os.WriteFile(src, []byte("disk image"), 0644))
+
+	d := New()
+	var lastCurrent int64
+	d.Progress = func(current, total int64) { lastCurrent = current }
+
+	for _, rawURL := range []string{Resolve("source.img", dir), src} {
+		etag, err := d.ETag(context.Background(), rawURL)
+		require.NoError(t, err)
+		assert.NotEmpty(t, etag)
+
+		dest := filepath.Join(dir, "dest.img")
+		require.NoError(t, d.Fetch(context.Background(), rawURL, dest))
+
+		got, err := os.ReadFile(dest)
+		require.NoError(t, err)
+		assert.Equal(t, "disk image", string(got))
+		assert.Equal(t, int64(len(got)), lastCurrent)
+	}
+}
+
+func TestUnsupportedScheme(t *testing.T) {
+	err := New().Fetch(context.Background(), "ftp://example.com/a.img", filepath.Join(t.TempDir(), "a.img"))
+	assert.ErrorContains(t, err, `unsupported url scheme "ftp"`)
+}
+
+func TestFetchFirst(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "mirror.img")
+	require.NoError(t, os.WriteFile(src, []byte("disk image"), 0644))
+
+	urls := []string{Resolve("missing.img", dir), Resolve("mirror.img", dir)}
+	d := New()
+	var logs []string
+	d.Log = func(format string, args ...any) { logs = append(logs, fmt.Sprintf(format, args...)) }
+
+	etag, err := d.ETagFirst(context.Background(), urls)
+	require.NoError(t, err)
+	assert.NotEmpty(t, etag)
+
+	dest := filepath.Join(dir, "dest.img")
+	fetched, err := d.FetchFirst(context.Background(), urls, dest)
+	require.NoError(t, err)
+	assert.Equal(t, urls[1], fetched)
+	require.Len(t, logs, 1)
+	assert.Contains(t, logs[0], ", trying "+urls[1])
+
+	got, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, "disk image", string(got))
+
+	_, err = d.FetchFirst(context.Background(), urls[:1], dest)
+	assert.ErrorContains(t, err, "missing.img")
+}
@@ -0,0 +1,59 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/gaboose/pipod/internal/iio"
+)
+
+// File is the transport for file URLs.
+type File struct{}
+
+// ETag is derived from the size and modification time of the file.
+func (File) ETag(ctx context.Context, u *url.URL) (string, error) {
+	st, err := os.Stat(filepath.FromSlash(u.Path))
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(`"%x-%x"`, st.Size(), st.ModTime().UnixNano()), nil
+}
+
+func (File) Fetch(ctx context.Context, u *url.URL, dest string, progress Progress) error {
+	src, err := os.Open(filepath.FromSlash(u.Path))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	st, err := src.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", src.Name(), err)
+	}
+
+	part := dest + ".part"
+	dst, err := os.Create(part)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", part, err)
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(progressWriter(dst, 0, st.Size(), progress), iio.ContextReader(ctx, src)); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", src.Name(), err)
+	}
+
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", part, err)
+	}
+
+	if err := os.Rename(part, dest); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", part, dest, err)
+	}
+
+	return nil
+}
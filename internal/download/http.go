@@ -0,0 +1,237 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// HTTP is the transport for http and https URLs. Interrupted downloads are
+// kept on disk and resumed with range requests, and transient errors are
+// retried with exponential backoff.
+type HTTP struct {
+	Client *http.Client
+
+	// Retries is the number of times a failed attempt is retried.
+	Retries    int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Log, if set, is called before a failed attempt is retried.
+	Log Log
+}
+
+func NewHTTP() *HTTP {
+	return &HTTP{
+		Client:     http.DefaultClient,
+		Retries:    5,
+		MinBackoff: time.Second,
+		MaxBackoff: 30 * time.Second,
+	}
+}
+
+// ETag returns a validator of the file at url. It falls back to
+// Last-Modified when the server does not send an ETag.
+func (d *HTTP) ETag(ctx context.Context, u *url.URL) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to make request: %w", err)
+	}
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to make request: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		return etag, nil
+	}
+	return resp.Header.Get("Last-Modified"), nil
+}
+
+// Fetch downloads u to dest. Bytes are written to dest.part first, which is
+// resumed if it already exists and renamed to dest once complete.
+func (d *HTTP) Fetch(ctx context.Context, u *url.URL, dest string, progress Progress) error {
+	part := dest + ".part"
+	resumable := true
+
+	for attempt := 0; ; attempt++ {
+		err := d.fetchOnce(ctx, u.String(), part, progress, &resumable)
+		if err == nil {
+			break
+		}
+
+		var te *transientError
+		if !errors.As(err, &te) || attempt >= d.Retries {
+			return err
+		}
+
+		wait := d.backoff(attempt)
+		if d.Log != nil {
+			d.Log("%v, retrying in %s", err, wait)
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if err := os.Rename(part, dest); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", part, dest, err)
+	}
+
+	return nil
+}
+
+func (d *HTTP) backoff(attempt int) time.Duration {
+	wait := d.MinBackoff << attempt
+	if wait > d.MaxBackoff || wait <= 0 {
+		wait = d.MaxBackoff
+	}
+	return wait
+}
+
+func (d *HTTP) fetchOnce(ctx context.Context, url string, part string, progress Progress, resumable *bool) error {
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", part, err)
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to seek %s: %w", part, err)
+	}
+	if !*resumable && offset > 0 {
+		if offset, err = restart(f); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to make request: %w", err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return classify(fmt.Errorf("failed to make request: %w", err))
+	}
+	defer resp.Body.Close()
+
+	*resumable = resp.Header.Get("Accept-Ranges") == "bytes"
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		start, err := contentRangeStart(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			*resumable = false
+			return &transientError{fmt.Errorf("server resumed at unexpected range %q", resp.Header.Get("Content-Range"))}
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		if size, err := contentRangeSize(resp.Header.Get("Content-Range")); err == nil && size == offset {
+			// the previous attempt got everything but failed before renaming
+			return nil
+		}
+		*resumable = false
+		return &transientError{fmt.Errorf("server rejected range %d-", offset)}
+	case resp.StatusCode == http.StatusOK:
+		if offset, err = restart(f); err != nil {
+			return err
+		}
+	default:
+		err := fmt.Errorf("unexpected status: %s", resp.Status)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout {
+			return &transientError{err}
+		}
+		return err
+	}
+
+	var total int64
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+
+	n, err := io.Copy(progressWriter(f, offset, total, progress), resp.Body)
+	if err != nil {
+		return classify(fmt.Errorf("failed to download: %w", err))
+	}
+
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return &transientError{fmt.Errorf("failed to download: %w", io.ErrUnexpectedEOF)}
+	}
+
+	return nil
+}
+
+func restart(f *os.File) (int64, error) {
+	if err := f.Truncate(0); err != nil {
+		return 0, fmt.Errorf("failed to truncate %s: %w", f.Name(), err)
+	}
+	return f.Seek(0, io.SeekStart)
+}
+
+// contentRangeStart parses the first byte position of "bytes 100-199/200".
+func contentRangeStart(s string) (int64, error) {
+	rng, ok := strings.CutPrefix(s, "bytes ")
+	if !ok {
+		return 0, fmt.Errorf("invalid content range %q", s)
+	}
+	start, _, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, fmt.Errorf("invalid content range %q", s)
+	}
+	return strconv.ParseInt(start, 10, 64)
+}
+
+// contentRangeSize parses the complete length of "bytes */200".
+func contentRangeSize(s string) (int64, error) {
+	_, size, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid content range %q", s)
+	}
+	return strconv.ParseInt(size, 10, 64)
+}
+
+// transientError is an error that is worth retrying.
+type transientError struct {
+	error
+}
+
+func (e *transientError) Unwrap() error { return e.error }
+
+func classify(err error) error {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return err
+	case errors.As(err, &netErr) && netErr.Timeout(),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, io.EOF):
+		return &transientError{err}
+	default:
+		return err
+	}
+}
@@ -0,0 +1,157 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyServer serves content with range support but fails the first
+// requests: a 503, then a connection dropped halfway through the body.
+type flakyServer struct {
+	content []byte
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r)
+	n := len(s.requests)
+	s.mu.Unlock()
+
+	switch n {
+	case 1:
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case 2:
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", "1048576")
+		w.WriteHeader(http.StatusOK)
+		w.Write(s.content[:len(s.content)/2])
+		panic(http.ErrAbortHandler)
+	default:
+		http.ServeContent(w, r, "image.img", time.Time{}, bytes.NewReader(s.content))
+	}
+}
+
+func newTestDownloader() *Downloader {
+	h := NewHTTP()
+	h.MinBackoff = time.Millisecond
+	h.MaxBackoff = time.Millisecond
+
+	d := New()
+	h.Log = d.log
+	d.Register("http", h)
+	return d
+}
+
+func TestFetchResume(t *testing.T) {
+	content := make([]byte, 1<<20)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+
+	fs := &flakyServer{content: content}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+
+	dest := filepath.Join(t.TempDir(), "image.img")
+	var lastCurrent, lastTotal int64
+	d := newTestDownloader()
+	d.Progress = func(current, total int64) {
+		lastCurrent, lastTotal = current, total
+	}
+
+	require.NoError(t, d.Fetch(context.Background(), srv.URL, dest))
+
+	got, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+	assert.NoFileExists(t, dest+".part")
+	assert.Equal(t, int64(len(content)), lastCurrent)
+	assert.Equal(t, int64(len(content)), lastTotal)
+
+	require.Len(t, fs.requests, 3)
+	assert.Empty(t, fs.requests[1].Header.Get("Range"))
+	assert.Equal(t, "bytes=524288-", fs.requests[2].Header.Get("Range"))
+}
+
+func TestFetchResumeExistingPart(t *testing.T) {
+	content := []byte("0123456789")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "image.img", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	dest := filepath.Join(t.TempDir(), "image.img")
+	require.NoError(t, os.WriteFile(dest+".part", content[:4], 0644))
+
+	require.NoError(t, newTestDownloader().Fetch(context.Background(), srv.URL, dest))
+
+	got, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+}
+
+func TestFetchNoRangeSupport(t *testing.T) {
+	content := []byte("0123456789")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	dest := filepath.Join(t.TempDir(), "image.img")
+	require.NoError(t, os.WriteFile(dest+".part", []byte("stale data from another file"), 0644))
+
+	require.NoError(t, newTestDownloader().Fetch(context.Background(), srv.URL, dest))
+
+	got, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+}
+
+func TestFetchPermanentError(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	dest := filepath.Join(t.TempDir(), "image.img")
+	err := newTestDownloader().Fetch(context.Background(), srv.URL, dest)
+	assert.ErrorContains(t, err, "404")
+	assert.Equal(t, 1, requests)
+}
+
+func TestFetchGiveUp(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	d := newTestDownloader()
+	d.transports["http"].(*HTTP).Retries = 2
+	var logs []string
+	d.Log = func(format string, args ...any) { logs = append(logs, fmt.Sprintf(format, args...)) }
+	err := d.Fetch(context.Background(), srv.URL, filepath.Join(t.TempDir(), "image.img"))
+	assert.ErrorContains(t, err, "502")
+	assert.Equal(t, 3, requests)
+	assert.Equal(t, []string{
+		"unexpected status: 502 Bad Gateway, retrying in 1ms",
+		"unexpected status: 502 Bad Gateway, retrying in 1ms",
+	}, logs)
+}
@@ -0,0 +1,100 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// netrcMachine is an entry of a netrc file. The default entry has an empty
+// name.
+type netrcMachine struct {
+	name     string
+	login    string
+	password string
+}
+
+// readNetrc parses the netrc file at path. A missing file has no entries.
+func readNetrc(path string) ([]netrcMachine, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read netrc: %w", err)
+	}
+
+	return parseNetrc(string(data)), nil
+}
+
+func parseNetrc(data string) []netrcMachine {
+	var machines []netrcMachine
+	var m *netrcMachine
+	var macdef bool
+
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+
+		// a macro definition ends with an empty line
+		if macdef {
+			macdef = len(fields) > 0
+			continue
+		}
+
+		for i := 0; i < len(fields); i++ {
+			var value string
+			if i+1 < len(fields) {
+				value = fields[i+1]
+			}
+
+			switch fields[i] {
+			case "machine":
+				machines = append(machines, netrcMachine{name: value})
+				m = &machines[len(machines)-1]
+				i++
+			case "default":
+				machines = append(machines, netrcMachine{})
+				m = &machines[len(machines)-1]
+			case "login":
+				if m != nil {
+					m.login = value
+				}
+				i++
+			case "password":
+				if m != nil {
+					m.password = value
+				}
+				i++
+			case "account":
+				i++
+			case "macdef":
+				macdef = true
+				i = len(fields)
+			}
+		}
+	}
+
+	return machines
+}
+
+// lookupNetrc returns the entry of host, or the default entry.
+func lookupNetrc(machines []netrcMachine, host string) (netrcMachine, bool) {
+	for _, m := range machines {
+		if m.name == host {
+			return m, true
+		}
+	}
+
+	for _, m := range machines {
+		if m.name == "" {
+			return m, true
+		}
+	}
+
+	return netrcMachine{}, false
+}
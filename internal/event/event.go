@@ -0,0 +1,261 @@
+// Package event describes the progress of pipod commands as a stream of
+// events. The terminal output and the JSON lines output are both renderings of
+// the same stream.
+package event
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Type string
+
+const (
+	// TypeStart starts a phase.
+	TypeStart Type = "start"
+	// TypeProgress counts the bytes processed by a phase.
+	TypeProgress Type = "progress"
+	// TypeEnd ends a phase.
+	TypeEnd Type = "end"
+	// TypeInfo is a message that isn't part of a phase.
+	TypeInfo Type = "info"
+	// TypeLog is a line of output of an external tool.
+	TypeLog Type = "log"
+	// TypeFile is a file updated by the sync phase.
+	TypeFile Type = "file"
+	// TypeResult is the final result of a command.
+	TypeResult Type = "result"
+	// TypeError is the error a command failed with.
+	TypeError Type = "error"
+)
+
+type Phase string
+
+const (
+	PhaseBuild      Phase = "build"
+	PhaseDownload   Phase = "download"
+	PhaseVerify     Phase = "verify"
+	PhaseDecompress Phase = "decompress"
+	PhaseExtract    Phase = "extract"
+	PhaseCopy       Phase = "copy"
+	PhaseCreate     Phase = "create"
+	PhaseGrow       Phase = "grow"
+	PhaseShrink     Phase = "shrink"
+	PhaseImport     Phase = "import"
+	PhaseManifest   Phase = "manifest"
+	PhaseSync       Phase = "sync"
+	PhaseBmap       Phase = "bmap"
+	PhaseCompress   Phase = "compress"
+	PhaseRename     Phase = "rename"
+	PhaseFlash      Phase = "flash"
+)
+
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     Type      `json:"type"`
+	Phase    Phase     `json:"phase,omitempty"`
+	Platform string    `json:"platform,omitempty"`
+	Message  string    `json:"message,omitempty"`
+
+	// Source and Stream name the tool and the output stream of a log line.
+	Source string `json:"source,omitempty"`
+	Stream string `json:"stream,omitempty"`
+
+	Bytes   *Bytes   `json:"bytes,omitempty"`
+	File    *File    `json:"file,omitempty"`
+	Summary *Summary `json:"summary,omitempty"`
+	Result  *Result  `json:"result,omitempty"`
+}
+
+// Bytes counts the progress of a phase. Total is 0 if unknown.
+type Bytes struct {
+	Current int64 `json:"current"`
+	Total   int64 `json:"total"`
+}
+
+// File is a path updated by the sync phase. Action is one of added, updated,
+// deleted or error.
+type File struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Summary counts the files updated by the sync phase so far.
+type Summary struct {
+	Added   int `json:"added"`
+	Updated int `json:"updated"`
+	Deleted int `json:"deleted"`
+	Errors  int `json:"errors"`
+}
+
+func (s Summary) String() string {
+	ret := fmt.Sprintf("added: %d updated: %d deleted: %d", s.Added, s.Updated, s.Deleted)
+	if s.Errors == 0 {
+		return ret
+	}
+
+	return fmt.Sprintf("%s errors: %d", ret, s.Errors)
+}
+
+// Result is what a command produced.
+type Result struct {
+	// Reference is the built container image or manifest list.
+	Reference string `json:"reference,omitempty"`
+	// Images are the container images built for each platform.
+	Images []string `json:"images,omitempty"`
+	// Disk is the path of the built disk image.
+	Disk string `json:"disk,omitempty"`
+}
+
+// Sink consumes events. Emit may be called concurrently.
+type Sink interface {
+	Emit(Event)
+}
+
+// Emitter stamps events and passes them to a sink.
+type Emitter struct {
+	sink     Sink
+	platform string
+}
+
+func NewEmitter(sink Sink) *Emitter {
+	return &Emitter{sink: sink}
+}
+
+// WithPlatform returns a copy of e that tags events with platform.
+func (e *Emitter) WithPlatform(platform string) *Emitter {
+	cp := *e
+	cp.platform = platform
+	return &cp
+}
+
+func (e *Emitter) Emit(ev Event) {
+	ev.Time = time.Now()
+	if ev.Platform == "" {
+		ev.Platform = e.platform
+	}
+	e.sink.Emit(ev)
+}
+
+// Start starts phase with a message.
+func (e *Emitter) Start(phase Phase, format string, args ...any) {
+	e.Emit(Event{Type: TypeStart, Phase: phase, Message: fmt.Sprintf(format, args...)})
+}
+
+func (e *Emitter) End(phase Phase) {
+	e.Emit(Event{Type: TypeEnd, Phase: phase})
+}
+
+// File emits a file updated by the sync phase along with the summary so far.
+func (e *Emitter) File(f File, message string, summary Summary) {
+	e.Emit(Event{Type: TypeFile, Phase: PhaseSync, Message: message, File: &f, Summary: &summary})
+}
+
+// EndSync ends the sync phase with its summary.
+func (e *Emitter) EndSync(summary Summary) {
+	e.Emit(Event{Type: TypeEnd, Phase: PhaseSync, Summary: &summary})
+}
+
+func (e *Emitter) Info(format string, args ...any) {
+	e.Emit(Event{Type: TypeInfo, Message: fmt.Sprintf(format, args...)})
+}
+
+func (e *Emitter) Result(r Result) {
+	e.Emit(Event{Type: TypeResult, Message: "Build complete.", Result: &r})
+}
+
+func (e *Emitter) Error(err error) {
+	e.Emit(Event{Type: TypeError, Message: err.Error()})
+}
+
+// Progress returns a tracker that emits the progress of phase. total is 0 if
+// unknown. Closing the tracker ends the phase.
+func (e *Emitter) Progress(phase Phase, total int64) *Tracker {
+	t := &Tracker{e: e, phase: phase}
+	t.total.Store(total)
+	return t
+}
+
+// LogWriter returns a writer that emits every line written to it as a log
+// event of source. stream is either stdout or stderr.
+func (e *Emitter) LogWriter(source, stream string) io.Writer {
+	return &logWriter{e: e, source: source, stream: stream}
+}
+
+// Tracker emits the progress of a phase. It is safe for concurrent use.
+type Tracker struct {
+	e       *Emitter
+	phase   Phase
+	current atomic.Int64
+	total   atomic.Int64
+	closed  atomic.Bool
+}
+
+func (t *Tracker) Set(current, total int64) {
+	t.current.Store(current)
+	t.total.Store(total)
+	t.emit()
+}
+
+func (t *Tracker) Add(n int64) {
+	t.current.Add(n)
+	t.emit()
+}
+
+func (t *Tracker) emit() {
+	t.e.Emit(Event{
+		Type:  TypeProgress,
+		Phase: t.phase,
+		Bytes: &Bytes{Current: t.current.Load(), Total: t.total.Load()},
+	})
+}
+
+// Close ends the phase. It can be called multiple times.
+func (t *Tracker) Close() error {
+	if t.closed.Swap(true) {
+		return nil
+	}
+	t.e.Emit(Event{
+		Type:  TypeEnd,
+		Phase: t.phase,
+		Bytes: &Bytes{Current: t.current.Load(), Total: t.total.Load()},
+	})
+	return nil
+}
+
+type logWriter struct {
+	e      *Emitter
+	source string
+	stream string
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.e.Emit(Event{
+			Type:    TypeLog,
+			Source:  w.source,
+			Stream:  w.stream,
+			Message: strings.TrimRight(string(w.buf[:i]), "\r"),
+		})
+		w.buf = w.buf[i+1:]
+	}
+
+	return len(p), nil
+}
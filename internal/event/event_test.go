@@ -0,0 +1,132 @@
+package event
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *recorder) Emit(ev Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+}
+
+func TestLogWriter(t *testing.T) {
+	var r recorder
+	w := NewEmitter(&r).WithPlatform("linux/arm64").LogWriter("podman", "stderr")
+
+	_, err := w.Write([]byte("first\r\nsec"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("ond\nunterminated"))
+	require.NoError(t, err)
+
+	require.Len(t, r.events, 2)
+	assert.Equal(t, "first", r.events[0].Message)
+	assert.Equal(t, "second", r.events[1].Message)
+	for _, ev := range r.events {
+		assert.Equal(t, TypeLog, ev.Type)
+		assert.Equal(t, "podman", ev.Source)
+		assert.Equal(t, "stderr", ev.Stream)
+		assert.Equal(t, "linux/arm64", ev.Platform)
+	}
+}
+
+func TestTracker(t *testing.T) {
+	var r recorder
+	tr := NewEmitter(&r).Progress(PhaseDownload, 10)
+	tr.Add(4)
+	tr.Set(6, 12)
+	require.NoError(t, tr.Close())
+	require.NoError(t, tr.Close())
+
+	require.Len(t, r.events, 3)
+	assert.Equal(t, &Bytes{Current: 4, Total: 10}, r.events[0].Bytes)
+	assert.Equal(t, &Bytes{Current: 6, Total: 12}, r.events[1].Bytes)
+	assert.Equal(t, TypeEnd, r.events[2].Type)
+	assert.Equal(t, &Bytes{Current: 6, Total: 12}, r.events[2].Bytes)
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEmitter(NewJSON(&buf)).WithPlatform("linux/arm64")
+
+	e.Start(PhaseDownload, "Downloading %s...", "image.img.xz")
+	tr := e.Progress(PhaseDownload, 100)
+	for range 100 {
+		tr.Add(1)
+	}
+	tr.Close()
+	e.File(File{Path: "/etc/hostname", Action: "added"}, "added /etc/hostname", Summary{Added: 1})
+	e.Result(Result{Reference: "localhost/image:latest"})
+	e.Error(errors.New("failed"))
+
+	var events []Event
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var ev Event
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &ev))
+		events = append(events, ev)
+	}
+
+	var types []Type
+	for _, ev := range events {
+		types = append(types, ev.Type)
+		assert.Equal(t, "linux/arm64", ev.Platform)
+		assert.False(t, ev.Time.IsZero())
+	}
+
+	// progress events are rate limited
+	assert.Equal(t, []Type{TypeStart, TypeProgress, TypeEnd, TypeFile, TypeResult, TypeError}, types)
+	assert.Equal(t, "Downloading image.img.xz...", events[0].Message)
+	assert.Equal(t, &Bytes{Current: 1, Total: 100}, events[1].Bytes)
+	assert.Equal(t, &Bytes{Current: 100, Total: 100}, events[2].Bytes)
+	assert.Equal(t, &File{Path: "/etc/hostname", Action: "added"}, events[3].File)
+	assert.Equal(t, "localhost/image:latest", events[4].Result.Reference)
+	assert.Equal(t, "failed", events[5].Message)
+}
+
+func TestTextParallel(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEmitter(&Text{Out: &buf, Err: &buf, Parallel: true}).WithPlatform("linux/arm64")
+
+	tr := e.Progress(PhaseDecompress, 100)
+	for range 100 {
+		tr.Add(1)
+	}
+	tr.Close()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	// the first one, one for every 10% and a final one
+	require.Len(t, lines, 12)
+	assert.Equal(t, blue+"[linux/arm64]"+reset+"   1% 1 B / 100 B", lines[0])
+	assert.Equal(t, blue+"[linux/arm64]"+reset+"  10% 10 B / 100 B", lines[1])
+	assert.Equal(t, blue+"[linux/arm64]"+reset+" 100% 100 B / 100 B", lines[11])
+}
+
+func TestTextSync(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEmitter(&Text{Out: &buf, Verbose: true})
+
+	e.Start(PhaseSync, "Syncing with out.img...")
+	e.File(File{Path: "/a", Action: "added"}, "added /a", Summary{Added: 1})
+	e.File(File{Path: "/b", Action: "deleted"}, "deleted /b", Summary{Added: 1, Deleted: 1})
+	e.EndSync(Summary{Added: 1, Deleted: 1})
+
+	assert.Equal(t, "Syncing with out.img...\n"+
+		syncPrefix+"added /a\n"+
+		syncPrefix+"deleted /b\n"+
+		syncPrefix+"added: 1 updated: 0 deleted: 1\n", buf.String())
+}
@@ -0,0 +1,43 @@
+package event
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// progressInterval limits the progress events of a phase written as JSON.
+const progressInterval = 500 * time.Millisecond
+
+// JSON writes events as JSON lines.
+type JSON struct {
+	mu           sync.Mutex
+	enc          *json.Encoder
+	lastProgress map[barKey]time.Time
+}
+
+func NewJSON(w io.Writer) *JSON {
+	return &JSON{
+		enc:          json.NewEncoder(w),
+		lastProgress: make(map[barKey]time.Time),
+	}
+}
+
+func (j *JSON) Emit(ev Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	key := barKey{ev.Platform, ev.Phase}
+	switch ev.Type {
+	case TypeProgress:
+		if ev.Time.Sub(j.lastProgress[key]) < progressInterval {
+			return
+		}
+		j.lastProgress[key] = ev.Time
+	case TypeEnd:
+		delete(j.lastProgress, key)
+	}
+
+	j.enc.Encode(ev)
+}
@@ -0,0 +1,231 @@
+package event
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	green          = "\033[32m"
+	blue           = "\033[34m"
+	reset          = "\033[0m"
+	cursorUp       = "\033[%dA"
+	eraseInDisplay = "\033[J"
+)
+
+// Text renders events for a terminal.
+type Text struct {
+	Out io.Writer
+	Err io.Writer
+	// Verbose prints every synced file instead of only the last one.
+	Verbose bool
+	// Parallel prefixes lines with the platform and logs progress as lines
+	// instead of drawing a bar, which stays readable when several platforms
+	// share the terminal.
+	Parallel bool
+
+	mu   sync.Mutex
+	bars map[barKey]*bar
+	// barShown is set while a bar is drawn on the last line
+	barShown  bool
+	syncShown bool
+}
+
+type barKey struct {
+	platform string
+	phase    Phase
+}
+
+type bar struct {
+	lastDraw    time.Time
+	lastDisplay string
+	lastStep    int64
+}
+
+func (t *Text) Emit(ev Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var prefix string
+	if t.Parallel && ev.Platform != "" {
+		prefix = blue + "[" + ev.Platform + "]" + reset + " "
+	}
+
+	if ev.Type != TypeProgress && ev.Type != TypeEnd {
+		t.clearBar()
+	}
+
+	switch ev.Type {
+	case TypeStart, TypeInfo:
+		if ev.Message != "" {
+			fmt.Fprintln(t.Out, prefix+ev.Message)
+		}
+	case TypeLog:
+		w := t.Out
+		if ev.Stream == "stderr" {
+			w = t.Err
+		}
+		fmt.Fprintln(w, green+"["+ev.Source+"]"+reset+" "+ev.Message)
+	case TypeProgress:
+		t.progress(prefix, ev)
+	case TypeEnd:
+		if ev.Bytes != nil {
+			t.endProgress(prefix, ev)
+		}
+		if ev.Phase == PhaseSync && ev.Summary != nil {
+			t.endSync(*ev.Summary)
+		}
+	case TypeFile:
+		t.file(ev)
+	case TypeResult:
+		fmt.Fprintln(t.Out, ev.Message)
+		if ev.Result.Reference != "" {
+			fmt.Fprintln(t.Out, ev.Result.Reference)
+		}
+		if ev.Result.Disk != "" {
+			fmt.Fprintln(t.Out, ev.Result.Disk)
+		}
+	}
+}
+
+func (t *Text) bar(ev Event) *bar {
+	if t.bars == nil {
+		t.bars = make(map[barKey]*bar)
+	}
+
+	key := barKey{ev.Platform, ev.Phase}
+	b, ok := t.bars[key]
+	if !ok {
+		b = &bar{lastStep: -1}
+		t.bars[key] = b
+	}
+	return b
+}
+
+func (t *Text) progress(prefix string, ev Event) {
+	b := t.bar(ev)
+	current, total := ev.Bytes.Current, ev.Bytes.Total
+
+	if t.Parallel {
+		step := int64(-1)
+		if total > 0 {
+			step = current * 10 / total
+		}
+		if step > b.lastStep || (total == 0 && ev.Time.Sub(b.lastDraw) > 10*time.Second) {
+			fmt.Fprintln(t.Out, prefix+progressLine(current, total))
+			b.lastStep, b.lastDraw = step, ev.Time
+		}
+		return
+	}
+
+	if ev.Time.Sub(b.lastDraw) < 40*time.Millisecond {
+		return
+	}
+
+	display := progressString(current, total)
+	if display == b.lastDisplay {
+		return
+	}
+
+	fmt.Fprintf(t.Out, "\r%s", display)
+	b.lastDraw, b.lastDisplay = ev.Time, display
+	t.barShown = true
+}
+
+// clearBar erases a drawn bar so that a line can be printed in its place. The
+// bar is redrawn on its next progress event.
+func (t *Text) clearBar() {
+	if !t.barShown {
+		return
+	}
+
+	fmt.Fprint(t.Out, "\r"+eraseInDisplay)
+	for _, b := range t.bars {
+		b.lastDraw, b.lastDisplay = time.Time{}, ""
+	}
+	t.barShown = false
+}
+
+func (t *Text) endProgress(prefix string, ev Event) {
+	delete(t.bars, barKey{ev.Platform, ev.Phase})
+
+	if t.Parallel {
+		fmt.Fprintln(t.Out, prefix+progressLine(ev.Bytes.Current, ev.Bytes.Total))
+	} else {
+		fmt.Fprintf(t.Out, "\r%s\n", progressString(ev.Bytes.Current, ev.Bytes.Total))
+		t.barShown = false
+	}
+}
+
+const syncPrefix = green + "[aferosync]" + reset + " "
+
+func (t *Text) file(ev Event) {
+	if t.Verbose {
+		fmt.Fprintln(t.Out, syncPrefix+ev.Message)
+		return
+	}
+
+	// keep only the last update and the summary on screen
+	if t.syncShown {
+		fmt.Fprintf(t.Out, cursorUp+"\r"+eraseInDisplay, 1)
+	}
+	fmt.Fprintln(t.Out, syncPrefix+ev.Message)
+	fmt.Fprint(t.Out, syncPrefix+ev.Summary.String())
+	t.syncShown = true
+}
+
+func (t *Text) endSync(summary Summary) {
+	if t.syncShown {
+		fmt.Fprint(t.Out, "\r"+eraseInDisplay)
+	}
+	fmt.Fprintln(t.Out, syncPrefix+summary.String())
+	t.syncShown = false
+}
+
+func ByteCountIEC(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB",
+		float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+func progressString(current, total int64) string {
+	const WIDTH = 40
+
+	if total == 0 {
+		fillPos := int(time.Now().Unix() % WIDTH)
+		bar := strings.Repeat(" ", fillPos) + "=" + strings.Repeat(" ", WIDTH-fillPos-1)
+		return fmt.Sprintf("[%s] %-10s", bar, ByteCountIEC(current))
+	}
+
+	filled := int(float64(current) / float64(total) * float64(WIDTH))
+	if filled > WIDTH {
+		filled = WIDTH
+	}
+
+	bar := strings.Repeat("=", filled)
+	if filled < WIDTH {
+		bar += ">" + strings.Repeat(" ", WIDTH-filled-1)
+	}
+	ratio := fmt.Sprintf("%s / %s", ByteCountIEC(current), ByteCountIEC(total))
+
+	return fmt.Sprintf("[%s] %-23s", bar, ratio)
+}
+
+func progressLine(current, total int64) string {
+	if total == 0 {
+		return ByteCountIEC(current)
+	}
+
+	return fmt.Sprintf("%3d%% %s / %s", current*100/total, ByteCountIEC(current), ByteCountIEC(total))
+}
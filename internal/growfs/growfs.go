@@ -0,0 +1,76 @@
+// Package growfs installs a systemd service into a root filesystem that grows
+// the root partition and filesystem to fill the disk on first boot.
+package growfs
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	SYSTEMD_DIR  = "/etc/systemd/system"
+	SERVICE_FILE = "/etc/systemd/system/pipod-growfs.service"
+	SERVICE_LINK = "/etc/systemd/system/sysinit.target.wants/pipod-growfs.service"
+	SCRIPT_FILE  = "/usr/local/sbin/pipod-growfs"
+)
+
+//go:embed pipod-growfs.service
+var serviceContents []byte
+
+//go:embed pipod-growfs
+var scriptContents []byte
+
+// Install adds and enables the service in fs and returns the paths it added.
+// It fails if fs has no systemd.
+func Install(fs afero.Fs) ([]string, error) {
+	st, err := fs.Stat(SYSTEMD_DIR)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat: %w", err)
+	} else if !st.IsDir() {
+		return nil, fmt.Errorf("%s is not a dir", SYSTEMD_DIR)
+	}
+
+	linker, ok := fs.(afero.Linker)
+	if !ok {
+		return nil, fmt.Errorf("filesystem doesn't support symlinks")
+	}
+
+	added := []string{}
+	for _, file := range []struct {
+		path     string
+		contents []byte
+		perm     os.FileMode
+	}{
+		{SERVICE_FILE, serviceContents, 0644},
+		{SCRIPT_FILE, scriptContents, 0755},
+	} {
+		if err := fs.MkdirAll(path.Dir(file.path), 0755); err != nil {
+			return nil, fmt.Errorf("failed to MkdirAll: %w", err)
+		}
+		if err := afero.WriteFile(fs, file.path, file.contents, file.perm); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", file.path, err)
+		}
+		// WriteFile only sets the mode of new files
+		if err := fs.Chmod(file.path, file.perm); err != nil {
+			return nil, fmt.Errorf("failed to chmod %s: %w", file.path, err)
+		}
+		added = append(added, file.path)
+	}
+
+	if err := fs.MkdirAll(path.Dir(SERVICE_LINK), 0755); err != nil {
+		return nil, fmt.Errorf("failed to MkdirAll: %w", err)
+	}
+	if err := fs.Remove(SERVICE_LINK); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove %s: %w", SERVICE_LINK, err)
+	}
+	if err := linker.SymlinkIfPossible(SERVICE_FILE, SERVICE_LINK); err != nil {
+		return nil, fmt.Errorf("failed to symlink %s: %w", SERVICE_LINK, err)
+	}
+	added = append(added, SERVICE_LINK)
+
+	return added, nil
+}
@@ -0,0 +1,37 @@
+package growfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstall(t *testing.T) {
+	dir := t.TempDir()
+	fs := afero.NewBasePathFs(afero.NewOsFs(), dir)
+
+	_, err := Install(fs)
+	assert.Error(t, err)
+
+	require.NoError(t, fs.MkdirAll(SYSTEMD_DIR, 0755))
+	added, err := Install(fs)
+	require.NoError(t, err)
+	assert.Equal(t, []string{SERVICE_FILE, SCRIPT_FILE, SERVICE_LINK}, added)
+
+	// installing twice replaces the files
+	_, err = Install(fs)
+	require.NoError(t, err)
+
+	st, err := os.Stat(filepath.Join(dir, SCRIPT_FILE))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), st.Mode().Perm())
+
+	// BasePathFs prefixes link targets with its base path
+	target, err := os.Readlink(filepath.Join(dir, SERVICE_LINK))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, SERVICE_FILE), target)
+}
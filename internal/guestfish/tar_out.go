@@ -1,6 +1,7 @@
 package guestfish
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -15,11 +16,33 @@ const (
 	prefix = green + "[guestfish]" + reset
 )
 
-var stderr = iio.Writer(os.Stderr.Write).WithPrefix(prefix)
+var stderr io.Writer = iio.Writer(os.Stderr.Write).WithPrefix(prefix)
 
-func TarOut(image string, partition string) io.ReadCloser {
-	ctx, closer := iio.ContextCloser()
-	guestfishCmd := exec.CommandContext(ctx, "guestfish", "--ro", "-a", image, "-m", partition, "--", "tar-out", "/", "-")
+// SetOutput redirects the error output of guestfish. It must be called before
+// running it.
+func SetOutput(errOut io.Writer) {
+	stderr = errOut
+}
+
+// Mount is a partition device mounted at a path. Parents must be mounted
+// before the partitions mounted under them.
+type Mount struct {
+	Device     string
+	Mountpoint string
+}
+
+// TarOut streams a tar archive of the filesystem of image, with partitions
+// mounted at mounts.
+func TarOut(ctx context.Context, image string, mounts []Mount) io.ReadCloser {
+	ctx, closer := iio.ContextCloser(ctx)
+
+	args := []string{"--ro", "-a", image}
+	for _, m := range mounts {
+		args = append(args, "-m", m.Device+":"+m.Mountpoint)
+	}
+	args = append(args, "--", "tar-out", "/", "-")
+
+	guestfishCmd := exec.CommandContext(ctx, "guestfish", args...)
 	guestfishCmd.Stderr = stderr
 
 	reader, writer := io.Pipe()
@@ -2,7 +2,9 @@ package iio
 
 import "context"
 
-func ContextCloser() (context.Context, Closer) {
-	ctx, cancel := context.WithCancel(context.Background())
+// ContextCloser returns a context derived from parent that is cancelled when
+// the closer is closed.
+func ContextCloser(parent context.Context) (context.Context, Closer) {
+	ctx, cancel := context.WithCancel(parent)
 	return ctx, Closer(func() error { cancel(); return nil })
 }
@@ -1,5 +1,21 @@
 package iio
 
+import (
+	"context"
+	"io"
+)
+
 type Reader func(p []byte) (n int, err error)
 
 func (r Reader) Read(p []byte) (n int, err error) { return r(p) }
+
+// ContextReader returns a reader that fails with the context error once ctx
+// is done.
+func ContextReader(ctx context.Context, r io.Reader) Reader {
+	return func(p []byte) (n int, err error) {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		return r.Read(p)
+	}
+}
@@ -1,5 +1,7 @@
 package iio
 
+import "sync"
+
 type Writer func(p []byte) (n int, err error)
 
 func (w Writer) Write(p []byte) (n int, err error) { return w(p) }
@@ -44,3 +46,14 @@ func appendNMap(nMap []int, incOld bool, newN int) []int {
 	}
 	return nMap
 }
+
+// Synchronized returns a writer that serializes calls to w so that it can be
+// shared between goroutines.
+func (w Writer) Synchronized() Writer {
+	var mu sync.Mutex
+	return func(p []byte) (n int, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return w(p)
+	}
+}
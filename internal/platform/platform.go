@@ -0,0 +1,123 @@
+// Package platform parses OCI platforms, e.g. linux/arm/v7, normalising the
+// common names of architectures, e.g. armhf, and their default variants.
+package platform
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Platform is an OCI platform in its normal form: aliases are replaced and
+// default variants are filled in or left out the way OCI registries do it.
+type Platform struct {
+	OS      string
+	Arch    string
+	Variant string
+}
+
+// variants are the architectures of OCI platforms with their variants.
+var variants = map[string][]string{
+	"386":      nil,
+	"amd64":    {"v1", "v2", "v3", "v4"},
+	"arm":      {"v5", "v6", "v7", "v8"},
+	"arm64":    {"v8", "v9"},
+	"loong64":  nil,
+	"mips64le": nil,
+	"ppc64le":  nil,
+	"riscv64":  nil,
+	"s390x":    nil,
+}
+
+// aliases are the OCI ARCH[/VARIANT] of common architecture names.
+var aliases = map[string]string{
+	"aarch64": "arm64",
+	"armel":   "arm/v5",
+	"armhf":   "arm/v7",
+	"armv6l":  "arm/v6",
+	"armv7l":  "arm/v7",
+	"i386":    "386",
+	"i686":    "386",
+	"x86_64":  "amd64",
+}
+
+var osRegexp = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// Parse parses an OS/ARCH[/VARIANT] platform. A lone ARCH is a linux one,
+// and architectures may be given by their aliases, e.g. linux/armhf is
+// linux/arm/v7.
+func Parse(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) == 1 {
+		parts = []string{"linux", parts[0]}
+	}
+	if len(parts) > 3 {
+		return Platform{}, fmt.Errorf("invalid platform %q, expected OS/ARCH[/VARIANT]", s)
+	}
+
+	if alias, ok := aliases[parts[1]]; ok {
+		if len(parts) == 3 {
+			return Platform{}, fmt.Errorf("invalid platform %q: %s already implies a variant", s, parts[1])
+		}
+		parts = append(parts[:1], strings.Split(alias, "/")...)
+	}
+
+	var variant string
+	if len(parts) == 3 {
+		variant = parts[2]
+	}
+
+	p, err := New(parts[0], parts[1], variant)
+	if err != nil {
+		return Platform{}, fmt.Errorf("invalid platform %q: %w", s, err)
+	}
+	return p, nil
+}
+
+// New returns the normal form of the platform os/arch/variant. Unlike Parse,
+// it doesn't accept aliases.
+func New(os, arch, variant string) (Platform, error) {
+	if !osRegexp.MatchString(os) {
+		return Platform{}, fmt.Errorf("invalid os %q", os)
+	}
+
+	archVariants, ok := variants[arch]
+	if !ok {
+		return Platform{}, fmt.Errorf("unknown architecture %q", arch)
+	}
+
+	// variants are written with or without the v, e.g. by uname
+	if variant != "" && !strings.HasPrefix(variant, "v") {
+		variant = "v" + variant
+	}
+	if variant != "" && !slices.Contains(archVariants, variant) {
+		return Platform{}, fmt.Errorf("unknown variant %q of %s", variant, arch)
+	}
+
+	switch {
+	case arch == "arm" && variant == "":
+		variant = "v7"
+	case arch == "arm64" && variant == "v8", arch == "amd64" && variant == "v1":
+		variant = ""
+	}
+
+	return Platform{OS: os, Arch: arch, Variant: variant}, nil
+}
+
+// String formats p as OS/ARCH[/VARIANT].
+func (p Platform) String() string {
+	if p.Variant == "" {
+		return p.OS + "/" + p.Arch
+	}
+	return p.OS + "/" + p.Arch + "/" + p.Variant
+}
+
+// Join formats platforms as a comma separated list.
+func Join(platforms []Platform) string {
+	s := make([]string, len(platforms))
+	for i, p := range platforms {
+		s[i] = p.String()
+	}
+	return strings.Join(s, ", ")
+}
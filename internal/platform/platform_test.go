@@ -0,0 +1,46 @@
+package platform
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	for s, want := range map[string]string{
+		"linux/arm64":    "linux/arm64",
+		"linux/arm64/v8": "linux/arm64",
+		"linux/arm64/v9": "linux/arm64/v9",
+		"linux/arm":      "linux/arm/v7",
+		"linux/arm/v6":   "linux/arm/v6",
+		"linux/arm/6":    "linux/arm/v6",
+		"linux/armhf":    "linux/arm/v7",
+		"linux/armv6l":   "linux/arm/v6",
+		"linux/armel":    "linux/arm/v5",
+		"linux/aarch64":  "linux/arm64",
+		"linux/amd64/v1": "linux/amd64",
+		"linux/amd64/v3": "linux/amd64/v3",
+		"linux/riscv64":  "linux/riscv64",
+		"aarch64":        "linux/arm64",
+		"armhf":          "linux/arm/v7",
+		"x86_64":         "linux/amd64",
+		"freebsd/amd64":  "freebsd/amd64",
+	} {
+		p, err := Parse(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, p.String(), s)
+	}
+
+	for s, msg := range map[string]string{
+		"linux":              `invalid platform "linux": unknown architecture "linux"`,
+		"linux/arm/v7/extra": `invalid platform "linux/arm/v7/extra", expected OS/ARCH[/VARIANT]`,
+		"Linux/arm64":        `invalid platform "Linux/arm64": invalid os "Linux"`,
+		"linux/arm/v9":       `invalid platform "linux/arm/v9": unknown variant "v9" of arm`,
+		"linux/386/v1":       `invalid platform "linux/386/v1": unknown variant "v1" of 386`,
+		"linux/armhf/v6":     `invalid platform "linux/armhf/v6": armhf already implies a variant`,
+	} {
+		_, err := Parse(s)
+		assert.EqualError(t, err, msg, s)
+	}
+}
@@ -0,0 +1,81 @@
+package podman
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ArtifactTransport fetches source files stored as single-file OCI artifacts,
+// referenced by URLs like oci://ghcr.io/gaboose/raspios-image:2025-10-01.
+type ArtifactTransport struct{}
+
+type artifactInspect struct {
+	Digest string `json:"Digest"`
+}
+
+// ETag pulls the artifact and returns its manifest digest.
+func (ArtifactTransport) ETag(ctx context.Context, u *url.URL) (string, error) {
+	ref := artifactReference(u)
+	if err := pullArtifact(ctx, ref); err != nil {
+		return "", err
+	}
+
+	out, err := exec.CommandContext(ctx, "podman", "artifact", "inspect", ref).Output()
+	if err != nil {
+		return "", fmt.Errorf("artifact inspect failed: %w", err)
+	}
+
+	var inspect artifactInspect
+	if err := json.Unmarshal(out, &inspect); err != nil {
+		return "", fmt.Errorf("unmarshal failed: %w", err)
+	}
+
+	return inspect.Digest, nil
+}
+
+func (ArtifactTransport) Fetch(ctx context.Context, u *url.URL, dest string, progress func(current, total int64)) error {
+	ref := artifactReference(u)
+	if err := pullArtifact(ctx, ref); err != nil {
+		return err
+	}
+
+	part := dest + ".part"
+	cmd := exec.CommandContext(ctx, "podman", "artifact", "extract", ref, part)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(part)
+		return fmt.Errorf("artifact extract failed: %w", err)
+	}
+
+	st, err := os.Stat(part)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", part, err)
+	}
+	progress(st.Size(), st.Size())
+
+	if err := os.Rename(part, dest); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", part, dest, err)
+	}
+
+	return nil
+}
+
+func artifactReference(u *url.URL) string {
+	return u.Host + "/" + strings.TrimPrefix(u.Path, "/")
+}
+
+func pullArtifact(ctx context.Context, ref string) error {
+	cmd := exec.CommandContext(ctx, "podman", "artifact", "pull", ref)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("artifact pull failed: %w", err)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package podman
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -17,26 +18,46 @@ type Image struct {
 
 type imageInspect []struct {
 	Labels json.RawMessage `json:"Labels"`
+	Size   int64           `json:"Size"`
 }
 
-func (i *Image) UnmarshalLabelsJson(labels any) error {
+func (i *Image) inspect() (imageInspect, error) {
 	cmd := exec.Command("podman", "inspect", i.Name, "--format", "json")
 	out, err := cmd.Output()
 	if err != nil {
-		return fmt.Errorf("inspect failed: %w", err)
+		return nil, fmt.Errorf("inspect failed: %w", err)
 	}
 
 	var inspect imageInspect
 	if err := json.Unmarshal(out, &inspect); err != nil {
-		return fmt.Errorf("unmarshal failed: %w", err)
+		return nil, fmt.Errorf("unmarshal failed: %w", err)
 	}
 	if len(inspect) == 0 {
-		return fmt.Errorf("no inspect data returned for image %s", i.Name)
+		return nil, fmt.Errorf("no inspect data returned for image %s", i.Name)
+	}
+
+	return inspect, nil
+}
+
+func (i *Image) UnmarshalLabelsJson(labels any) error {
+	inspect, err := i.inspect()
+	if err != nil {
+		return err
 	}
 
 	return json.Unmarshal(inspect[0].Labels, labels)
 }
 
+// Size returns the size of the filesystem of the image in bytes.
+func (i *Image) Size() (int64, error) {
+	inspect, err := i.inspect()
+	if err != nil {
+		return 0, err
+	}
+
+	return inspect[0].Size, nil
+}
+
 func (i *Image) UnmarshalLabelsToml(labels any) error {
 	jsonMap := map[string]string{}
 	if err := i.UnmarshalLabelsJson(&jsonMap); err != nil {
@@ -52,7 +73,7 @@ func (i *Image) UnmarshalLabelsToml(labels any) error {
 }
 
 func (i Image) TarOut() (io.ReadCloser, error) {
-	ctx, closer := iio.ContextCloser()
+	ctx, closer := iio.ContextCloser(context.Background())
 	cmd := exec.CommandContext(ctx, "podman", "unshare", "bash", "-c", fmt.Sprintf("tar cC $(podman image mount %q) .", i.Name))
 	pr, pw := io.Pipe()
 	cmd.Stdout = pw
@@ -1,12 +1,13 @@
 package podman
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os/exec"
-	"strings"
 
 	"github.com/gaboose/pipod/internal/iio"
+	"github.com/gaboose/pipod/internal/platform"
 	"github.com/pelletier/go-toml/v2"
 )
 
@@ -46,19 +47,19 @@ func WithVariant(variant string) ImportOption {
 	})
 }
 
-func WithPlatform(platform string) ImportOption {
+// WithPlatform sets the OS, architecture and variant of the image. Aliases,
+// e.g. linux/armhf, are normalised.
+func WithPlatform(s string) ImportOption {
 	return importOpt(func(opts *importOpts) {
-		parts := strings.Split(platform, "/")
-		if len(parts) < 2 || len(parts) > 3 {
-			opts.errs = append(opts.errs, fmt.Errorf("failed to parse platform %s", platform))
+		p, err := platform.Parse(s)
+		if err != nil {
+			opts.errs = append(opts.errs, err)
 			return
 		}
 
-		opts.os = parts[0]
-		opts.arch = parts[1]
-		if len(parts) > 2 {
-			opts.variant = parts[2]
-		}
+		opts.os = p.OS
+		opts.arch = p.Arch
+		opts.variant = p.Variant
 	})
 }
 
@@ -108,7 +109,7 @@ func WithLabelsToml(labels any) ImportOption {
 	})
 }
 
-func Import(reader io.ReadCloser, opts ...ImportOption) (*Image, error) {
+func Import(ctx context.Context, reader io.ReadCloser, opts ...ImportOption) (*Image, error) {
 	defer reader.Close()
 
 	var oo = importOpts{}
@@ -142,7 +143,7 @@ func Import(reader io.ReadCloser, opts ...ImportOption) (*Image, error) {
 
 	lastLineWriter, lastLineBuf := iio.LastLine()
 
-	podmanCmd := exec.Command("podman", podmanArgs...)
+	podmanCmd := exec.CommandContext(ctx, "podman", podmanArgs...)
 	podmanCmd.Stdin = reader
 	podmanCmd.Stdout = io.MultiWriter(stdout, lastLineWriter)
 	podmanCmd.Stderr = stderr
@@ -1,11 +1,14 @@
 package podman
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os/exec"
+	"slices"
 
 	"github.com/gaboose/pipod/internal/iio"
+	"github.com/gaboose/pipod/internal/platform"
 )
 
 type manifestCreateOpts struct {
@@ -46,3 +49,75 @@ func CreateManifest(name string, images []string, opts ...ManifestCreateOption)
 
 	return lastLineBuf.String(), nil
 }
+
+type manifestInspect struct {
+	Manifests []struct {
+		Platform struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+			Variant      string `json:"variant"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+type platformInspect []struct {
+	OS           string `json:"Os"`
+	Architecture string `json:"Architecture"`
+	Variant      string `json:"Variant"`
+}
+
+// Platforms returns the platforms of the manifest list or image ref. A
+// manifest list is looked up in registries if it isn't stored locally, an
+// image must be.
+func Platforms(ref string) ([]platform.Platform, error) {
+	var platforms []platform.Platform
+	add := func(os, arch, variant string) error {
+		// e.g. attestation manifests of docker buildx
+		if os == "unknown" || arch == "unknown" {
+			return nil
+		}
+		p, err := platform.New(os, arch, variant)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(platforms, p) {
+			platforms = append(platforms, p)
+		}
+		return nil
+	}
+
+	if out, err := exec.Command("podman", "manifest", "inspect", ref).Output(); err == nil {
+		var inspect manifestInspect
+		if err := json.Unmarshal(out, &inspect); err != nil {
+			return nil, fmt.Errorf("unmarshal failed: %w", err)
+		}
+		for _, m := range inspect.Manifests {
+			if err := add(m.Platform.OS, m.Platform.Architecture, m.Platform.Variant); err != nil {
+				return nil, err
+			}
+		}
+		if len(platforms) > 0 {
+			return platforms, nil
+		}
+	}
+
+	out, err := exec.Command("podman", "image", "inspect", ref, "--format", "json").Output()
+	if err != nil {
+		return nil, fmt.Errorf("inspect failed: %w", err)
+	}
+
+	var inspect platformInspect
+	if err := json.Unmarshal(out, &inspect); err != nil {
+		return nil, fmt.Errorf("unmarshal failed: %w", err)
+	}
+	for _, i := range inspect {
+		if err := add(i.OS, i.Architecture, i.Variant); err != nil {
+			return nil, err
+		}
+	}
+	if len(platforms) == 0 {
+		return nil, fmt.Errorf("no platforms found for image %s", ref)
+	}
+
+	return platforms, nil
+}
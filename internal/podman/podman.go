@@ -1,6 +1,7 @@
 package podman
 
 import (
+	"io"
 	"os"
 
 	"github.com/gaboose/pipod/internal/iio"
@@ -12,5 +13,12 @@ const (
 	prefix = green + "[podman]" + reset
 )
 
-var stdout = iio.Writer(os.Stdout.Write).WithPrefix(prefix)
-var stderr = iio.Writer(os.Stderr.Write).WithPrefix(prefix)
+var stdout io.Writer = iio.Writer(os.Stdout.Write).WithPrefix(prefix)
+var stderr io.Writer = iio.Writer(os.Stderr.Write).WithPrefix(prefix)
+
+// SetOutput redirects the output of podman commands. It must be called before
+// running any.
+func SetOutput(out, errOut io.Writer) {
+	stdout = out
+	stderr = errOut
+}
@@ -0,0 +1,72 @@
+// Package sparse writes files with holes in place of zero blocks, so that
+// mostly empty disk images take little real disk space.
+package sparse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// BlockSize is the granularity at which zeros are detected.
+const BlockSize = 4096
+
+var zeroBlock = make([]byte, BlockSize)
+
+// Writer writes sequentially to a new or empty file, seeking over blocks that
+// are all zero instead of writing them. Close must be called to set the final
+// file size.
+type Writer struct {
+	f      *os.File
+	offset int64
+}
+
+func NewWriter(f *os.File) *Writer {
+	return &Writer{f: f}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// split at block boundaries of the file
+		n := BlockSize - int(w.offset%BlockSize)
+		if n > len(p) {
+			n = len(p)
+		}
+		chunk := p[:n]
+
+		if !bytes.Equal(chunk, zeroBlock[:n]) {
+			if _, err := w.f.WriteAt(chunk, w.offset); err != nil {
+				return written, err
+			}
+		}
+
+		w.offset += int64(n)
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// Close extends the file over trailing holes. It does not close the file.
+func (w *Writer) Close() error {
+	return w.f.Truncate(w.offset)
+}
+
+// Copy copies src to dst, which must be new or empty, leaving holes for zero
+// blocks.
+func Copy(dst *os.File, src io.Reader) (int64, error) {
+	w := NewWriter(dst)
+	n, err := io.CopyBuffer(w, src, make([]byte, 256*BlockSize))
+	if err != nil {
+		return n, err
+	}
+
+	if err := w.Close(); err != nil {
+		return n, fmt.Errorf("failed to truncate %s: %w", dst.Name(), err)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,55 @@
+package sparse
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopy(t *testing.T) {
+	data := make([]byte, 64*BlockSize)
+	_, err := rand.Read(data[BlockSize/2 : BlockSize+10])
+	require.NoError(t, err)
+	_, err = rand.Read(data[10*BlockSize : 11*BlockSize])
+	require.NoError(t, err)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "image.img"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	// a reader that returns odd sized chunks
+	n, err := Copy(f, &chunkReader{r: bytes.NewReader(data), size: 1000})
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+
+	got, err := os.ReadFile(f.Name())
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	st, err := f.Stat()
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), st.Size())
+
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		// at most the three data blocks plus filesystem overhead
+		assert.Less(t, sys.Blocks*512, int64(len(data)/2))
+	}
+}
+
+type chunkReader struct {
+	r    *bytes.Reader
+	size int
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if len(p) > cr.size {
+		p = p[:cr.size]
+	}
+	return cr.r.Read(p)
+}
@@ -0,0 +1,72 @@
+// Package verify checks source files against published checksum files and
+// detached signatures.
+package verify
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ParseChecksumFile finds the sha256 checksum of name in a checksum file. Both
+// the coreutils format ("<sum>  <name>") and the BSD format
+// ("SHA256 (<name>) = <sum>") are accepted, and BSD lines of other algorithms
+// are skipped. Only a file with a single checksum of no name matches any name.
+func ParseChecksumFile(data []byte, name string) (string, error) {
+	name = path.Base(name)
+
+	type entry struct {
+		sum  string
+		name string
+	}
+	var entries []entry
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if algo, rest, ok := strings.Cut(line, " ("); ok && !strings.Contains(algo, " ") {
+			fileName, sum, ok := strings.Cut(rest, ") = ")
+			if !ok {
+				return "", fmt.Errorf("invalid checksum line %q", line)
+			}
+			if !strings.EqualFold(algo, "SHA256") {
+				continue
+			}
+			entries = append(entries, entry{sum: sum, name: fileName})
+			continue
+		}
+
+		sum, fileName, _ := strings.Cut(line, " ")
+		fileName = strings.TrimLeft(strings.TrimSpace(fileName), "*")
+		entries = append(entries, entry{sum: sum, name: fileName})
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read checksum file: %w", err)
+	}
+
+	for _, e := range entries {
+		if _, err := hex.DecodeString(e.sum); err != nil || len(e.sum) != sha256.Size*2 {
+			return "", fmt.Errorf("invalid sha256 checksum %q", e.sum)
+		}
+	}
+
+	if len(entries) == 1 && entries[0].name == "" {
+		return strings.ToLower(entries[0].sum), nil
+	}
+
+	for _, e := range entries {
+		if path.Base(e.name) == name {
+			return strings.ToLower(e.sum), nil
+		}
+	}
+
+	return "", fmt.Errorf("no checksum for %s", name)
+}
@@ -0,0 +1,71 @@
+package verify
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseChecksumFile(t *testing.T) {
+	const (
+		sumA = "79146135607ffe8acac94e5ff501de6fc49583117de5ad08c45a32c73ae2a027"
+		sumB = "22a02428e7de5345ccf865fa3e2fe06f3aa56afdde98bc23d9d91e83320b3511"
+	)
+
+	t.Run("Single", func(t *testing.T) {
+		data := []byte(sumA + "  2025-10-01-raspios-trixie-arm64-lite.img.xz\n")
+		sum, err := ParseChecksumFile(data, "https://example.com/2025-10-01-raspios-trixie-arm64-lite.img.xz")
+		assert.NoError(t, err)
+		assert.Equal(t, sumA, sum)
+
+		_, err = ParseChecksumFile(data, "https://example.com/other.img.xz")
+		assert.ErrorContains(t, err, "no checksum for other.img.xz")
+	})
+
+	t.Run("SumOnly", func(t *testing.T) {
+		sum, err := ParseChecksumFile([]byte(sumA+"\n"), "a.img.xz")
+		assert.NoError(t, err)
+		assert.Equal(t, sumA, sum)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		data := "# SHA256SUMS\n" + sumA + "  a.img.xz\n" + sumB + " *b.img.xz\n"
+		sum, err := ParseChecksumFile([]byte(data), "https://example.com/images/b.img.xz")
+		assert.NoError(t, err)
+		assert.Equal(t, sumB, sum)
+	})
+
+	t.Run("BSD", func(t *testing.T) {
+		data := "SHA256 (a.img.xz) = " + sumA + "\nSHA256 (b.img.xz) = " + sumB + "\n"
+		sum, err := ParseChecksumFile([]byte(data), "a.img.xz")
+		assert.NoError(t, err)
+		assert.Equal(t, sumA, sum)
+	})
+
+	t.Run("BSDOtherAlgorithm", func(t *testing.T) {
+		sha512 := sumA + sumB
+		data := "SHA512 (a.img.xz) = " + sha512 + "\nSHA256 (a.img.xz) = " + sumA + "\n"
+		sum, err := ParseChecksumFile([]byte(data), "a.img.xz")
+		assert.NoError(t, err)
+		assert.Equal(t, sumA, sum)
+
+		_, err = ParseChecksumFile([]byte("SHA512 (a.img.xz) = "+sha512+"\n"), "a.img.xz")
+		assert.ErrorContains(t, err, "no checksum for a.img.xz")
+	})
+
+	t.Run("SHA512SUMS", func(t *testing.T) {
+		_, err := ParseChecksumFile([]byte(sumA+sumB+"  a.img.xz\n"), "a.img.xz")
+		assert.ErrorContains(t, err, "invalid sha256 checksum")
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		data := sumA + "  a.img.xz\n" + sumB + "  b.img.xz\n"
+		_, err := ParseChecksumFile([]byte(data), "c.img.xz")
+		assert.ErrorContains(t, err, "no checksum for c.img.xz")
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := ParseChecksumFile([]byte("<html>not found</html>"), "a.img.xz")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,156 @@
+package verify
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	minisignUntrustedComment = "untrusted comment:"
+	minisignTrustedComment   = "trusted comment: "
+)
+
+// minisign algorithms: Ed signs the file, ED signs its BLAKE2b-512 hash.
+var (
+	minisignAlgLegacy    = [2]byte{'E', 'd'}
+	minisignAlgPrehashed = [2]byte{'E', 'D'}
+)
+
+type minisignPublicKey struct {
+	keyID [8]byte
+	key   ed25519.PublicKey
+}
+
+type minisignSignature struct {
+	alg            [2]byte
+	keyID          [8]byte
+	sig            []byte
+	trustedComment string
+	globalSig      []byte
+}
+
+func verifyMinisign(keyring []string, sigBts []byte, path string) error {
+	sig, err := parseMinisignSignature(sigBts)
+	if err != nil {
+		return err
+	}
+
+	keys, err := readKeys(keyring)
+	if err != nil {
+		return err
+	}
+
+	var pub *minisignPublicKey
+	for _, keyBts := range keys {
+		k, err := parseMinisignPublicKey(keyBts)
+		if err != nil {
+			// not a minisign key, e.g. an OpenPGP key in the same keyring
+			continue
+		}
+		if k.keyID == sig.keyID {
+			pub = k
+			break
+		}
+	}
+	if pub == nil {
+		return fmt.Errorf("%w: minisign key %X", ErrNoTrustedKey, reverse(sig.keyID))
+	}
+
+	var message []byte
+	switch sig.alg {
+	case minisignAlgPrehashed:
+		h, _ := blake2b.New512(nil)
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.Copy(h, f); err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		message = h.Sum(nil)
+	case minisignAlgLegacy:
+		if message, err = os.ReadFile(path); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported minisign algorithm %q", sig.alg[:])
+	}
+
+	if !ed25519.Verify(pub.key, message, sig.sig) {
+		return fmt.Errorf("invalid minisign signature")
+	}
+
+	global := append(append([]byte{}, sig.sig...), sig.trustedComment...)
+	if !ed25519.Verify(pub.key, global, sig.globalSig) {
+		return fmt.Errorf("invalid minisign trusted comment signature")
+	}
+
+	return nil
+}
+
+func parseMinisignPublicKey(bts []byte) (*minisignPublicKey, error) {
+	var line string
+	for _, l := range strings.Split(string(bts), "\n") {
+		if l = strings.TrimSpace(l); l != "" && !strings.HasPrefix(l, minisignUntrustedComment) {
+			line = l
+			break
+		}
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(line)
+	if err != nil || len(raw) != 2+8+ed25519.PublicKeySize || [2]byte(raw[:2]) != minisignAlgLegacy {
+		return nil, fmt.Errorf("invalid minisign public key")
+	}
+
+	return &minisignPublicKey{
+		keyID: [8]byte(raw[2:10]),
+		key:   ed25519.PublicKey(raw[10:]),
+	}, nil
+}
+
+func parseMinisignSignature(bts []byte) (*minisignSignature, error) {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(bts))
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], minisignTrustedComment) {
+		return nil, fmt.Errorf("invalid minisign signature file")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(raw) != 2+8+ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid minisign signature")
+	}
+
+	globalSig, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid minisign trusted comment signature")
+	}
+
+	return &minisignSignature{
+		alg:            [2]byte(raw[:2]),
+		keyID:          [8]byte(raw[2:10]),
+		sig:            raw[10:],
+		trustedComment: strings.TrimPrefix(lines[2], minisignTrustedComment),
+		globalSig:      globalSig,
+	}, nil
+}
+
+// reverse returns the key id in the order minisign prints it.
+func reverse(id [8]byte) []byte {
+	out := make([]byte, len(id))
+	for i, b := range id {
+		out[len(id)-1-i] = b
+	}
+	return out
+}
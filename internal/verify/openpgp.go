@@ -0,0 +1,100 @@
+package verify
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const armorPublicKeyBegin = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+
+func verifyOpenPGP(keyring []string, sig []byte, path string) error {
+	if _, err := exec.LookPath("gpgv"); err != nil {
+		return fmt.Errorf("gpgv is required to verify OpenPGP signatures: %w", err)
+	}
+
+	keys, err := readKeys(keyring)
+	if err != nil {
+		return err
+	}
+
+	// gpgv only reads binary keyrings
+	var binaryKeyring []byte
+	for _, keyBts := range keys {
+		if bytes.HasPrefix(keyBts, []byte(minisignUntrustedComment)) {
+			continue
+		}
+
+		if bytes.Contains(keyBts, []byte(armorPublicKeyBegin)) {
+			if keyBts, err = dearmor(keyBts); err != nil {
+				return err
+			}
+		}
+		binaryKeyring = append(binaryKeyring, keyBts...)
+	}
+	if len(binaryKeyring) == 0 {
+		return fmt.Errorf("%w: no OpenPGP keys in keyring", ErrNoTrustedKey)
+	}
+
+	dir, err := os.MkdirTemp("", "pipod-gpgv-")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyringPath := filepath.Join(dir, "keyring.gpg")
+	if err := os.WriteFile(keyringPath, binaryKeyring, 0600); err != nil {
+		return fmt.Errorf("failed to write keyring: %w", err)
+	}
+
+	sigPath := filepath.Join(dir, "signature")
+	if err := os.WriteFile(sigPath, sig, 0600); err != nil {
+		return fmt.Errorf("failed to write signature: %w", err)
+	}
+
+	cmd := exec.Command("gpgv", "--homedir", dir, "--keyring", keyringPath, sigPath, path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("invalid OpenPGP signature: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// dearmor decodes ASCII armored OpenPGP blocks.
+func dearmor(bts []byte) ([]byte, error) {
+	var out []byte
+	var body strings.Builder
+	inBlock, inBody := false, false
+
+	scanner := bufio.NewScanner(bytes.NewReader(bts))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "-----BEGIN PGP"):
+			inBlock, inBody = true, false
+			body.Reset()
+		case strings.HasPrefix(line, "-----END PGP"):
+			decoded, err := base64.StdEncoding.DecodeString(body.String())
+			if err != nil {
+				return nil, fmt.Errorf("invalid armored key: %w", err)
+			}
+			out = append(out, decoded...)
+			inBlock = false
+		case !inBlock:
+		case !inBody:
+			// armor headers end with an empty line
+			inBody = line == ""
+		case strings.HasPrefix(line, "="):
+			// CRC24 checksum
+		default:
+			body.WriteString(line)
+		}
+	}
+
+	return out, scanner.Err()
+}
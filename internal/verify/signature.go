@@ -0,0 +1,38 @@
+package verify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var ErrNoTrustedKey = errors.New("no trusted key")
+
+// Signature verifies a detached signature of the file at path against the
+// trusted public keys in keyring. Both minisign and OpenPGP signatures are
+// supported. OpenPGP signatures are checked with gpgv. Verification never
+// touches the network.
+func Signature(keyring []string, sig []byte, path string) error {
+	if len(keyring) == 0 {
+		return ErrNoTrustedKey
+	}
+
+	if bytes.HasPrefix(sig, []byte(minisignUntrustedComment)) {
+		return verifyMinisign(keyring, sig, path)
+	}
+
+	return verifyOpenPGP(keyring, sig, path)
+}
+
+func readKeys(keyring []string) ([][]byte, error) {
+	var keys [][]byte
+	for _, keyFile := range keyring {
+		bts, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key: %w", err)
+		}
+		keys = append(keys, bts)
+	}
+	return keys, nil
+}
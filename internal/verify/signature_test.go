@@ -0,0 +1,108 @@
+package verify
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignKey generates a minisign key pair and writes the public key to dir.
+func minisignKey(t *testing.T, dir string, name string) (ed25519.PrivateKey, [8]byte, string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	var keyID [8]byte
+	_, err = rand.Read(keyID[:])
+	require.NoError(t, err)
+
+	raw := append(append([]byte("Ed"), keyID[:]...), pub...)
+	path := filepath.Join(dir, name)
+	pubFile := fmt.Sprintf("untrusted comment: minisign public key\n%s\n", base64.StdEncoding.EncodeToString(raw))
+	require.NoError(t, os.WriteFile(path, []byte(pubFile), 0644))
+
+	return priv, keyID, path
+}
+
+func minisignSign(priv ed25519.PrivateKey, keyID [8]byte, alg string, data []byte) []byte {
+	message := data
+	if alg == "ED" {
+		sum := blake2b.Sum512(data)
+		message = sum[:]
+	}
+
+	sig := ed25519.Sign(priv, message)
+	trustedComment := "timestamp:1760000000\tfile:image.img.xz"
+	globalSig := ed25519.Sign(priv, append(append([]byte{}, sig...), trustedComment...))
+
+	raw := append(append([]byte(alg), keyID[:]...), sig...)
+	return fmt.Appendf(nil, "untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(raw), trustedComment, base64.StdEncoding.EncodeToString(globalSig))
+}
+
+func TestMinisign(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("disk image")
+	path := filepath.Join(dir, "image.img.xz")
+	require.NoError(t, os.WriteFile(path, data, 0644))
+
+	priv, keyID, pubPath := minisignKey(t, dir, "trusted.pub")
+	_, _, otherPath := minisignKey(t, dir, "other.pub")
+
+	for _, alg := range []string{"ED", "Ed"} {
+		t.Run(alg, func(t *testing.T) {
+			sig := minisignSign(priv, keyID, alg, data)
+			assert.NoError(t, Signature([]string{otherPath, pubPath}, sig, path))
+
+			assert.ErrorIs(t, Signature([]string{otherPath}, sig, path), ErrNoTrustedKey)
+			assert.ErrorIs(t, Signature(nil, sig, path), ErrNoTrustedKey)
+
+			tampered := filepath.Join(dir, "tampered.img.xz")
+			require.NoError(t, os.WriteFile(tampered, []byte("disk imagE"), 0644))
+			assert.ErrorContains(t, Signature([]string{pubPath}, sig, tampered), "invalid minisign signature")
+		})
+	}
+}
+
+func TestOpenPGP(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg not installed")
+	}
+	if _, err := exec.LookPath("gpgv"); err != nil {
+		t.Skip("gpgv not installed")
+	}
+
+	dir := t.TempDir()
+	home := filepath.Join(dir, "gnupg")
+	require.NoError(t, os.Mkdir(home, 0700))
+	gpg := func(args ...string) []byte {
+		cmd := exec.Command("gpg", append([]string{"--homedir", home, "--batch", "--passphrase", "", "--pinentry-mode", "loopback"}, args...)...)
+		out, err := cmd.Output()
+		require.NoError(t, err)
+		return out
+	}
+
+	path := filepath.Join(dir, "image.img.xz")
+	require.NoError(t, os.WriteFile(path, []byte("disk image"), 0644))
+
+	gpg("--quick-gen-key", "Pipod Test <test@example.com>", "ed25519", "sign", "never")
+	armoredKey := filepath.Join(dir, "key.asc")
+	require.NoError(t, os.WriteFile(armoredKey, gpg("--export", "--armor"), 0644))
+	binaryKey := filepath.Join(dir, "key.gpg")
+	require.NoError(t, os.WriteFile(binaryKey, gpg("--export"), 0644))
+	sig := gpg("--detach-sign", "--armor", "--output", "-", path)
+
+	assert.NoError(t, Signature([]string{armoredKey}, sig, path))
+	assert.NoError(t, Signature([]string{binaryKey}, sig, path))
+
+	require.NoError(t, os.WriteFile(path, []byte("disk imagE"), 0644))
+	assert.ErrorContains(t, Signature([]string{armoredKey}, sig, path), "invalid OpenPGP signature")
+}
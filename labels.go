@@ -1,23 +1,243 @@
 package main
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+
+	"github.com/gaboose/pipod/internal/download"
+	"github.com/pelletier/go-toml/v2"
+)
+
+const (
+	pipodLabelPrefix = "com.github.gaboose.pipod."
+
+	labelSourceURL           = "com.github.gaboose.pipod.source.url"
+	labelSourceMirrors       = "com.github.gaboose.pipod.source.mirrors"
+	labelSourceSHA256        = "com.github.gaboose.pipod.source.sha256"
+	labelSourceSHA256URL     = "com.github.gaboose.pipod.source.sha256.url"
+	labelSourceSHA512        = "com.github.gaboose.pipod.source.sha512"
+	labelSourceSignatureURL  = "com.github.gaboose.pipod.source.signature.url"
+	labelSourceArchiveMember = "com.github.gaboose.pipod.source.archive.member"
+
+	labelSourcePartitionsImport = "com.github.gaboose.pipod.source.partitions.import"
+
+	labelBuildVersion         = "com.github.gaboose.pipod.build.version"
+	labelBuildSpecSHA256      = "com.github.gaboose.pipod.build.spec.sha256"
+	labelSourceDownloadSHA256 = "com.github.gaboose.pipod.source.download.sha256"
+	labelSourceImageSize      = "com.github.gaboose.pipod.source.image.size"
+	labelSourceDiskLayout     = "com.github.gaboose.pipod.source.disk.layout"
+	labelDiskLayout           = "com.github.gaboose.pipod.disk.layout"
+	labelOCICreated           = "org.opencontainers.image.created"
+)
+
+// provenanceLabels are set by container build to record how an image was
+// built. They can't be set in build specs.
+var provenanceLabels = []string{
+	labelBuildVersion,
+	labelBuildSpecSHA256,
+	labelSourceDownloadSHA256,
+	labelSourceImageSize,
+	labelSourceDiskLayout,
+	labelDiskLayout,
+}
 
 type PipodLabels struct {
 	SourceURL              string `toml:"com.github.gaboose.pipod.source.url"`
+	SourceMirrors          string `toml:"com.github.gaboose.pipod.source.mirrors,omitempty"`
 	SourceSHA256           string `toml:"com.github.gaboose.pipod.source.sha256,omitempty"`
+	SourceSHA256URL        string `toml:"com.github.gaboose.pipod.source.sha256.url,omitempty"`
+	SourceSHA512           string `toml:"com.github.gaboose.pipod.source.sha512,omitempty"`
+	SourceSignatureURL     string `toml:"com.github.gaboose.pipod.source.signature.url,omitempty"`
 	SourcePartitionsImport string `toml:"com.github.gaboose.pipod.source.partitions.import,omitempty"`
+	SourceArchiveMember    string `toml:"com.github.gaboose.pipod.source.archive.member,omitempty"`
+
+	BuildVersion         string `toml:"com.github.gaboose.pipod.build.version,omitempty"`
+	BuildSpecSHA256      string `toml:"com.github.gaboose.pipod.build.spec.sha256,omitempty"`
+	SourceDownloadSHA256 string `toml:"com.github.gaboose.pipod.source.download.sha256,omitempty"`
+	SourceImageSize      string `toml:"com.github.gaboose.pipod.source.image.size,omitempty"`
+	SourceDiskLayout     string `toml:"com.github.gaboose.pipod.source.disk.layout,omitempty"`
+	DiskLayout           string `toml:"com.github.gaboose.pipod.disk.layout,omitempty"`
 }
 
-func (pdl *PipodLabels) validate() error {
+// parsePipodLabels returns the com.github.gaboose.pipod.* labels of labels.
+func parsePipodLabels(labels map[string]string) (PipodLabels, error) {
+	var pdl PipodLabels
+
+	bts, err := toml.Marshal(labels)
+	if err != nil {
+		return pdl, fmt.Errorf("failed to marshal labels: %w", err)
+	}
+
+	if err := toml.Unmarshal(bts, &pdl); err != nil {
+		return pdl, fmt.Errorf("failed to unmarshal labels: %w", err)
+	}
+
+	return pdl, nil
+}
+
+// isPipodLabel reports whether label is one of the fields of PipodLabels.
+func isPipodLabel(label string) bool {
+	t := reflect.TypeFor[PipodLabels]()
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("toml"), ",")
+		if name == label {
+			return true
+		}
+	}
+	return false
+}
+
+// labelError is a problem with the value of a label.
+type labelError struct {
+	label string
+	msg   string
+}
+
+func (e *labelError) Error() string {
+	return e.label + ": " + e.msg
+}
+
+// check returns all problems with the labels.
+func (pdl *PipodLabels) check() []*labelError {
+	var errs []*labelError
+	report := func(label, format string, args ...any) {
+		errs = append(errs, &labelError{label: label, msg: fmt.Sprintf(format, args...)})
+	}
+
 	if pdl.SourceURL == "" {
-		return fmt.Errorf(`com.github.gaboose.pipod.source.url not found`)
+		report(labelSourceURL, "not found")
+	}
+
+	urls := []struct {
+		label string
+		urls  []string
+	}{
+		{labelSourceURL, []string{pdl.SourceURL}},
+		{labelSourceMirrors, pdl.GetSourceMirrors()},
+		{labelSourceSHA256URL, []string{pdl.SourceSHA256URL}},
+		{labelSourceSignatureURL, []string{pdl.SourceSignatureURL}},
+	}
+	for _, u := range urls {
+		for _, rawURL := range u.urls {
+			if rawURL == "" {
+				continue
+			}
+			if err := checkURL(rawURL); err != nil {
+				report(u.label, "%s", err)
+			}
+		}
+	}
+
+	if pdl.SourceSHA256 != "" && !isHex(pdl.SourceSHA256, 64) {
+		report(labelSourceSHA256, "%q is not a sha256 hash", pdl.SourceSHA256)
+	}
+
+	if pdl.SourceSHA512 != "" && !isHex(pdl.SourceSHA512, 128) {
+		report(labelSourceSHA512, "%q is not a sha512 hash", pdl.SourceSHA512)
+	}
+
+	if _, err := path.Match(pdl.GetSourceArchiveMember(), ""); err != nil {
+		report(labelSourceArchiveMember, "invalid pattern %q", pdl.SourceArchiveMember)
+	}
+
+	if _, err := pdl.GetSourcePartitionsImport(); err != nil {
+		report(labelSourcePartitionsImport, "%s", err)
+	}
+
+	return errs
+}
+
+func (pdl *PipodLabels) validate() error {
+	var errs []error
+	for _, err := range pdl.check() {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// checkURL checks that rawURL can be downloaded from. Labels end up in
+// published images, so URLs must not hold credentials.
+func checkURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url %q", rawURL)
+	}
+
+	if u.User != nil {
+		return fmt.Errorf("url must not contain credentials, use ~/.netrc or PIPOD_TOKEN_<HOST> instead")
+	}
+
+	switch u.Scheme {
+	case "http", "https", "oci":
+		if u.Host == "" {
+			return fmt.Errorf("url %q has no host", rawURL)
+		}
+	case "", "file":
+	default:
+		return fmt.Errorf("url %q has an unsupported scheme %q", rawURL, u.Scheme)
 	}
 
 	return nil
 }
 
-func (pdl *PipodLabels) GetSourcePartitionsImport() string {
-	return withDefault(pdl.SourcePartitionsImport, "sda2")
+func isHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, r := range strings.ToLower(s) {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// GetSourcePartitionsImport returns the partitions to import and where to
+// mount them.
+func (pdl *PipodLabels) GetSourcePartitionsImport() (partitionMounts, error) {
+	return parsePartitionMounts(withDefault(pdl.SourcePartitionsImport, "sda2"))
+}
+
+func (pdl *PipodLabels) GetSourceArchiveMember() string {
+	return withDefault(pdl.SourceArchiveMember, "*.img")
+}
+
+// GetSourceMirrors returns the comma separated mirror URLs.
+func (pdl *PipodLabels) GetSourceMirrors() []string {
+	var mirrors []string
+	for _, mirror := range strings.Split(pdl.SourceMirrors, ",") {
+		if mirror = strings.TrimSpace(mirror); mirror != "" {
+			mirrors = append(mirrors, mirror)
+		}
+	}
+	return mirrors
+}
+
+// resolve returns a copy of pdl with the URLs that are plain paths resolved
+// against dir.
+func (pdl PipodLabels) resolve(dir string) PipodLabels {
+	for _, u := range []*string{&pdl.SourceURL, &pdl.SourceSHA256URL, &pdl.SourceSignatureURL} {
+		if *u != "" {
+			*u = download.Resolve(*u, dir)
+		}
+	}
+
+	var mirrors []string
+	for _, mirror := range pdl.GetSourceMirrors() {
+		mirrors = append(mirrors, download.Resolve(mirror, dir))
+	}
+	pdl.SourceMirrors = strings.Join(mirrors, ",")
+
+	return pdl
+}
+
+// GetSourceURLs returns the source URL followed by its mirrors.
+func (pdl *PipodLabels) GetSourceURLs() []string {
+	return append([]string{pdl.SourceURL}, pdl.GetSourceMirrors()...)
 }
 
 func withDefault(target string, def string) string {
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gaboose/afero-guestfs/libguestfs.org/guestfs"
+)
+
+// diskLayout is the partition layout of a disk image, recorded in the
+// com.github.gaboose.pipod.source.disk.layout and
+// com.github.gaboose.pipod.disk.layout labels as JSON.
+type diskLayout struct {
+	// Table is the partition table type, msdos or gpt, or empty if the disk
+	// has none.
+	Table string `json:"table"`
+	// ID is the disk identifier, e.g. a1b2c3d4 for msdos or a GUID for gpt.
+	ID string `json:"id,omitempty"`
+	// Size is the size of the disk in bytes.
+	Size       int64             `json:"size,omitempty"`
+	Partitions []partitionLayout `json:"partitions"`
+}
+
+// partitionLayout describes a partition of a disk image. Start and Size are
+// in bytes.
+type partitionLayout struct {
+	Device   string `json:"device"`
+	Start    int64  `json:"start"`
+	Size     int64  `json:"size"`
+	FSType   string `json:"fstype,omitempty"`
+	UUID     string `json:"uuid,omitempty"`
+	PartUUID string `json:"partuuid,omitempty"`
+	Label    string `json:"label,omitempty"`
+}
+
+// readImageLayout returns the partition layout of image.
+func readImageLayout(image string) (*diskLayout, error) {
+	g, err := launchGuestfs(image, true)
+	if err != nil {
+		return nil, err
+	}
+	defer g.Close()
+
+	return readDiskLayout(g)
+}
+
+// readDiskLayout returns the partition layout of the disk image added to g.
+func readDiskLayout(g *guestfs.Guestfs) (*diskLayout, error) {
+	devices, err := g.List_devices()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list devices: %w", err)
+	}
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("no disk")
+	}
+	device := devices[0]
+
+	size, err := g.Blockdev_getsize64(device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get size of %s: %w", device, err)
+	}
+
+	table, err := g.Part_get_parttype(device)
+	if err != nil {
+		// a disk image without a partition table, e.g. a bare ext4 root
+		// filesystem, has an empty layout
+		if tags, blkidErr := g.Blkid(device); blkidErr != nil || tags["PTTYPE"] == "" {
+			return &diskLayout{Size: size}, nil
+		}
+		return nil, fmt.Errorf("failed to get partition table type of %s: %w", device, err)
+	}
+
+	parts, err := g.Part_list(device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list partitions of %s: %w", device, err)
+	}
+
+	layout := &diskLayout{Table: table, Size: size}
+	if tags, err := g.Blkid(device); err == nil {
+		layout.ID = tags["PTUUID"]
+	}
+
+	for _, p := range *parts {
+		part := partitionLayout{
+			Device: fmt.Sprintf("%s%d", device, p.Part_num),
+			Start:  int64(p.Part_start),
+			Size:   int64(p.Part_size),
+		}
+
+		// partitions without a filesystem have no tags
+		if tags, err := g.Blkid(part.Device); err == nil {
+			part.FSType = tags["TYPE"]
+			part.UUID = tags["UUID"]
+			part.PartUUID = tags["PARTUUID"]
+			part.Label = tags["LABEL"]
+		}
+
+		layout.Partitions = append(layout.Partitions, part)
+	}
+
+	return layout, nil
+}
+
+// diff returns how got differs from l.
+func (l *diskLayout) diff(got *diskLayout) []string {
+	var diffs []string
+	differ := func(what, got, want any) {
+		if got != want {
+			diffs = append(diffs, fmt.Sprintf("%s is %#v, expected %#v", what, got, want))
+		}
+	}
+
+	differ("partition table", got.Table, l.Table)
+	differ("disk identifier", got.ID, l.ID)
+	// layouts recorded by older versions have no size
+	if l.Size != 0 {
+		differ("disk size", got.Size, l.Size)
+	}
+
+	gotParts := map[string]partitionLayout{}
+	for _, p := range got.Partitions {
+		gotParts[p.Device] = p
+	}
+
+	for _, want := range l.Partitions {
+		p, ok := gotParts[want.Device]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("%s is missing", want.Device))
+			continue
+		}
+		delete(gotParts, want.Device)
+
+		differ(want.Device+" start", p.Start, want.Start)
+		differ(want.Device+" size", p.Size, want.Size)
+		differ(want.Device+" filesystem type", p.FSType, want.FSType)
+		differ(want.Device+" uuid", strings.ToLower(p.UUID), strings.ToLower(want.UUID))
+		differ(want.Device+" partuuid", strings.ToLower(p.PartUUID), strings.ToLower(want.PartUUID))
+		differ(want.Device+" label", p.Label, want.Label)
+	}
+
+	for _, p := range got.Partitions {
+		if _, ok := gotParts[p.Device]; ok {
+			diffs = append(diffs, fmt.Sprintf("%s is unexpected", p.Device))
+		}
+	}
+
+	return diffs
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskLayoutDiff(t *testing.T) {
+	var want diskLayout
+	require.NoError(t, json.Unmarshal([]byte(`{"table":"msdos","id":"a1b2c3d4","partitions":[
+		{"device":"/dev/sda1","start":4194304,"size":536870912,"fstype":"vfat","uuid":"4EF5-6F55","partuuid":"a1b2c3d4-01","label":"bootfs"},
+		{"device":"/dev/sda2","start":541065216,"size":2147483648,"fstype":"ext4","uuid":"ce208fd3-38a8-424a-87a2-cd44114eb820","partuuid":"a1b2c3d4-02","label":"rootfs"}
+	]}`), &want))
+
+	got := want
+	got.Partitions = []partitionLayout{want.Partitions[0], want.Partitions[1]}
+	got.Partitions[0].UUID = "4ef5-6f55"
+	assert.Empty(t, want.diff(&got))
+
+	got.ID = "e5f6a7b8"
+	got.Partitions[1].Size = 4294967296
+	got.Partitions[1].FSType = "btrfs"
+	got.Partitions = append(got.Partitions, partitionLayout{Device: "/dev/sda3"})
+	assert.Equal(t, []string{
+		`disk identifier is "e5f6a7b8", expected "a1b2c3d4"`,
+		`/dev/sda2 size is 4294967296, expected 2147483648`,
+		`/dev/sda2 filesystem type is "btrfs", expected "ext4"`,
+		`/dev/sda3 is unexpected`,
+	}, want.diff(&got))
+
+	got = diskLayout{Table: "gpt", ID: "a1b2c3d4", Partitions: want.Partitions[:1]}
+	assert.Equal(t, []string{
+		`partition table is "gpt", expected "msdos"`,
+		`/dev/sda2 is missing`,
+	}, want.diff(&got))
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gaboose/pipod/internal/platform"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pelletier/go-toml/v2/unstable"
+)
+
+// specError is a problem in a build spec.
+type specError struct {
+	file string
+	line int // 0 if unknown
+	key  []string
+	msg  string
+}
+
+func (e *specError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.file)
+	if e.line > 0 {
+		fmt.Fprintf(&b, ":%d", e.line)
+	}
+	b.WriteString(": ")
+	if len(e.key) > 0 {
+		b.WriteString(tomlKey(e.key) + ": ")
+	}
+	b.WriteString(e.msg)
+	return b.String()
+}
+
+// parseSpec decodes and validates the build spec data read from file. Unlike
+// a plain decode, it returns all problems found, with the lines they are on.
+// Variables in label values are replaced, with vars taking precedence over
+// the vars table of the spec.
+func parseSpec(file string, data []byte, vars map[string]string) (*Spec, []error) {
+	spec, lines, errs := decodeSpec(file, data, nil)
+	if spec == nil {
+		return nil, errs
+	}
+
+	report := func(key []string, format string, args ...any) {
+		pos := lines.find(key)
+		errs = append(errs, &specError{
+			file: cmp.Or(pos.file, file),
+			line: pos.line,
+			key:  key,
+			msg:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	allVars := map[string]string{}
+	maps.Copy(allVars, spec.Vars)
+	maps.Copy(allVars, vars)
+	sv := newSpecVars(allVars)
+	for _, name := range slices.Sorted(maps.Keys(allVars)) {
+		if _, err := sv.lookup(name); err != nil {
+			report([]string{"vars", name}, "%s", err)
+		}
+	}
+
+	for i, step := range spec.Update {
+		key := []string{"update", strconv.Itoa(i)}
+		if step.Index == "" {
+			report(key, "no index")
+		}
+
+		match, err := sv.interpolateRegexp(step.Match)
+		if err != nil {
+			report(append(key, "match"), "%s", err)
+			continue
+		}
+		re, err := regexp.Compile(match)
+		if err != nil {
+			report(append(key, "match"), "%s", err)
+			continue
+		}
+
+		var named bool
+		for _, name := range re.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			named = true
+			if _, ok := allVars[name]; !ok {
+				report(append(key, "match"), "sets undefined variable %q", name)
+			}
+		}
+		if !named {
+			report(append(key, "match"), "no named groups, e.g. (?P<release>...)")
+		}
+	}
+
+	interpolateLabels := func(key []string, labels map[string]string) {
+		for _, label := range slices.Sorted(maps.Keys(labels)) {
+			v, err := sv.interpolate(labels[label])
+			if err != nil {
+				report(append(slices.Clone(key), label), "%s", err)
+			}
+			labels[label] = v
+		}
+	}
+
+	interpolateLabels([]string{"labels"}, spec.Labels)
+	for _, label := range slices.Sorted(maps.Keys(spec.Labels)) {
+		if !strings.HasPrefix(label, pipodLabelPrefix) {
+			continue
+		}
+		if slices.Contains(provenanceLabels, label) {
+			report([]string{"labels", label}, "set by container build")
+		} else if isPipodLabel(label) {
+			report([]string{"labels", label}, "pipod labels only take effect in platform labels")
+		} else {
+			report([]string{"labels", label}, "unknown pipod label")
+		}
+	}
+
+	if len(spec.Platform) == 0 {
+		report([]string{"platform"}, "no platforms")
+	}
+
+	// platform keys by their normal form
+	normalized := map[string]string{}
+	for _, name := range slices.Sorted(maps.Keys(spec.Platform)) {
+		if p, err := platform.Parse(name); err != nil {
+			report([]string{"platform", name}, "%s", err)
+		} else if other, ok := normalized[p.String()]; ok {
+			report([]string{"platform", name}, "same platform as %q", other)
+		} else {
+			normalized[p.String()] = name
+		}
+
+		platform := spec.Platform[name]
+		interpolateLabels([]string{"platform", name, "labels"}, platform.Labels)
+
+		for _, label := range slices.Sorted(maps.Keys(platform.Labels)) {
+			if slices.Contains(provenanceLabels, label) {
+				report([]string{"platform", name, "labels", label}, "set by container build")
+			} else if strings.HasPrefix(label, pipodLabelPrefix) && !isPipodLabel(label) {
+				report([]string{"platform", name, "labels", label}, "unknown pipod label")
+			}
+		}
+
+		pipod, err := parsePipodLabels(platform.Labels)
+		if err != nil {
+			report([]string{"platform", name, "labels"}, "%s", err)
+			continue
+		}
+		for _, err := range pipod.check() {
+			report([]string{"platform", name, "labels", err.label}, "%s", err.msg)
+		}
+
+		platform.pipod = pipod
+		spec.Platform[name] = platform
+	}
+
+	// aliases such as linux/armhf are built as the platform they name
+	for normal, name := range normalized {
+		if normal != name {
+			spec.Platform[normal] = spec.Platform[name]
+			delete(spec.Platform, name)
+		}
+	}
+
+	if spec.Disk != nil {
+		if _, err := spec.Disk.layout(); err != nil {
+			report([]string{"disk"}, "%s", err)
+		}
+	}
+
+	slices.SortStableFunc(errs, func(a, b error) int {
+		var aErr, bErr *specError
+		errors.As(a, &aErr)
+		errors.As(b, &bErr)
+		return cmp.Or(cmp.Compare(aErr.file, bErr.file), cmp.Compare(aErr.line, bErr.line))
+	})
+
+	return spec, errs
+}
+
+// decodeSpec decodes the build spec data read from file and merges it into
+// the spec it extends. The lines of keys are those of the file that last set
+// them. extending holds the files that extend this one, to detect cycles.
+func decodeSpec(file string, data []byte, extending []string) (*Spec, keyLines, []error) {
+	var errs []error
+	lines := parseKeyLines(file, data)
+
+	var spec Spec
+	err := toml.NewDecoder(bytes.NewReader(data)).DisallowUnknownFields().Decode(&spec)
+
+	var strictErr *toml.StrictMissingError
+	var decodeErr *toml.DecodeError
+	if errors.As(err, &strictErr) {
+		for _, e := range strictErr.Errors {
+			row, _ := e.Position()
+			errs = append(errs, &specError{file: file, line: row, key: e.Key(), msg: "unknown key"})
+		}
+	} else if errors.As(err, &decodeErr) {
+		row, _ := decodeErr.Position()
+		return nil, nil, []error{&specError{file: file, line: row, key: decodeErr.Key(), msg: decodeErr.Error()}}
+	} else if err != nil {
+		return nil, nil, []error{fmt.Errorf("%s: %w", file, err)}
+	}
+
+	if spec.Extends == "" {
+		return &spec, lines, errs
+	}
+
+	extendsErr := func(format string, args ...any) (*Spec, keyLines, []error) {
+		return nil, nil, append(errs, &specError{
+			file: file,
+			line: lines.find([]string{"extends"}).line,
+			key:  []string{"extends"},
+			msg:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	basePath := spec.Extends
+	if !filepath.IsAbs(basePath) {
+		basePath = filepath.Join(filepath.Dir(file), basePath)
+	}
+
+	extending = append(extending, filepath.Clean(file))
+	if slices.Contains(extending, filepath.Clean(basePath)) {
+		return extendsErr("%s extends itself", basePath)
+	}
+
+	baseData, err := os.ReadFile(basePath)
+	if err != nil {
+		return extendsErr("failed to read %s: %s", basePath, err)
+	}
+
+	base, baseLines, baseErrs := decodeSpec(basePath, baseData, extending)
+	errs = append(errs, baseErrs...)
+	if base == nil {
+		return nil, nil, errs
+	}
+
+	maps.Copy(baseLines, lines)
+	return base.extend(&spec), baseLines, errs
+}
+
+// position is a line in a file.
+type position struct {
+	file string
+	line int
+}
+
+// keyLines maps keys of TOML documents to the position they are defined at.
+type keyLines map[string]position
+
+func parseKeyLines(file string, data []byte) keyLines {
+	lines := keyLines{}
+
+	var p unstable.Parser
+	p.Reset(data)
+
+	var table []string
+	arrays := map[string]int{}
+	for p.NextExpression() {
+		expr := p.Expression()
+		switch expr.Kind {
+		case unstable.Table:
+			table = lines.add(&p, file, nil, expr.Key())
+		case unstable.ArrayTable:
+			// elements of arrays of tables are keyed by their index
+			table = lines.add(&p, file, nil, expr.Key())
+			table = arrayTableKey(table, arrays)
+			lines[strings.Join(table, "\x00")] = position{file: file, line: keyLine(&p, expr.Key())}
+		case unstable.KeyValue:
+			lines.addKeyValue(&p, file, table, expr)
+		}
+	}
+
+	return lines
+}
+
+func (kl keyLines) addKeyValue(p *unstable.Parser, file string, table []string, expr *unstable.Node) {
+	key := kl.add(p, file, table, expr.Key())
+
+	if value := expr.Value(); value.Kind == unstable.InlineTable {
+		it := value.Children()
+		for it.Next() {
+			kl.addKeyValue(p, file, key, it.Node())
+		}
+	}
+}
+
+// add records the position of every prefix of the dotted key it under table
+// and returns the full key.
+func (kl keyLines) add(p *unstable.Parser, file string, table []string, it unstable.Iterator) []string {
+	key := slices.Clone(table)
+	for it.Next() {
+		node := it.Node()
+		key = append(key, string(node.Data))
+		if _, ok := kl[strings.Join(key, "\x00")]; !ok {
+			kl[strings.Join(key, "\x00")] = position{file: file, line: p.Shape(node.Raw).Start.Line}
+		}
+	}
+	return key
+}
+
+// arrayTableKey returns the key of the next element of the array of tables
+// key. arrays counts the elements seen so far.
+func arrayTableKey(key []string, arrays map[string]int) []string {
+	joined := strings.Join(key, "\x00")
+	i := arrays[joined]
+	arrays[joined]++
+	return append(key, strconv.Itoa(i))
+}
+
+// keyLine returns the line of the last part of a dotted key.
+func keyLine(p *unstable.Parser, it unstable.Iterator) int {
+	var line int
+	for it.Next() {
+		line = p.Shape(it.Node().Raw).Start.Line
+	}
+	return line
+}
+
+// find returns the position of key, or of its closest parent if key isn't in
+// the document. It returns the zero position if none are.
+func (kl keyLines) find(key []string) position {
+	for i := len(key); i > 0; i-- {
+		if pos, ok := kl[strings.Join(key[:i], "\x00")]; ok {
+			return pos
+		}
+	}
+	return position{}
+}
+
+var bareKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// tomlKey formats key as a dotted TOML key.
+func tomlKey(key []string) string {
+	parts := make([]string, len(key))
+	for i, k := range key {
+		if bareKeyRegexp.MatchString(k) {
+			parts[i] = k
+		} else {
+			parts[i] = fmt.Sprintf("%q", k)
+		}
+	}
+	return strings.Join(parts, ".")
+}
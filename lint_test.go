@@ -0,0 +1,252 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func errorStrings(errs []error) []string {
+	var ret []string
+	for _, err := range errs {
+		ret = append(ret, err.Error())
+	}
+	return ret
+}
+
+func TestParseSpec(t *testing.T) {
+	spec, errs := parseSpec("pipod.toml", []byte(`[labels]
+"org.opencontainers.image.source" = "https://github.com/gaboose/pipod"
+
+[platform.'linux/arm/v7'.labels]
+"org.opencontainers.image.title" = "raspios"
+"com.github.gaboose.pipod.source.url" = "https://example.com/image.img.xz"
+"com.github.gaboose.pipod.source.sha256" = "79146135607FFE8ACAC94E5FF501DE6FC49583117DE5AD08C45A32C73AE2A027"
+`), nil)
+	require.Empty(t, errs)
+
+	platform := spec.Platform["linux/arm/v7"]
+	assert.Equal(t, "raspios", platform.Labels["org.opencontainers.image.title"])
+	assert.Equal(t, "https://example.com/image.img.xz", platform.pipod.SourceURL)
+}
+
+func TestParseSpecErrors(t *testing.T) {
+	_, errs := parseSpec("pipod.toml", []byte(`platforms = 1
+
+[labels]
+"com.github.gaboose.pipod.source.partitions.import" = "sda2"
+
+[platform.'linux/armhf'.labels]
+"com.github.gaboose.pipod.source.url" = "https://example.com/image.img.xz"
+"com.github.gaboose.pipod.source.sha265" = "abc"
+"com.github.gaboose.pipod.source.sha256" = "abc"
+
+[platform.'linux/arm64']
+labels = { "com.github.gaboose.pipod.source.mirrors" = "ftp://example.com/image.img.xz" }
+`), nil)
+
+	assert.Equal(t, []string{
+		`pipod.toml:1: platforms: unknown key`,
+		`pipod.toml:4: labels."com.github.gaboose.pipod.source.partitions.import": pipod labels only take effect in platform labels`,
+		`pipod.toml:8: platform."linux/armhf".labels."com.github.gaboose.pipod.source.sha265": unknown pipod label`,
+		`pipod.toml:9: platform."linux/armhf".labels."com.github.gaboose.pipod.source.sha256": "abc" is not a sha256 hash`,
+		`pipod.toml:12: platform."linux/arm64".labels."com.github.gaboose.pipod.source.url": not found`,
+		`pipod.toml:12: platform."linux/arm64".labels."com.github.gaboose.pipod.source.mirrors": url "ftp://example.com/image.img.xz" has an unsupported scheme "ftp"`,
+	}, errorStrings(errs))
+}
+
+func TestParseSpecSyntaxError(t *testing.T) {
+	_, errs := parseSpec("pipod.toml", []byte(`[platform.'linux/arm64'.labels]
+"com.github.gaboose.pipod.source.url" = https://example.com/image.img.xz
+`), nil)
+	require.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "pipod.toml:2: ")
+}
+
+func TestParseSpecPlatforms(t *testing.T) {
+	spec, errs := parseSpec("pipod.toml", []byte(`[platform.'linux/armhf'.labels]
+"com.github.gaboose.pipod.source.url" = "https://example.com/armhf.img.xz"
+
+[platform.'linux/arm64/v8'.labels]
+"com.github.gaboose.pipod.source.url" = "https://example.com/arm64.img.xz"
+
+[platform.'linux/amd64/v3'.labels]
+"com.github.gaboose.pipod.source.url" = "https://example.com/amd64.img.xz"
+`), nil)
+	require.Empty(t, errs)
+	assert.Equal(t, []string{"linux/amd64/v3", "linux/arm/v7", "linux/arm64"}, slices.Sorted(maps.Keys(spec.Platform)))
+	assert.Equal(t, "https://example.com/armhf.img.xz", spec.Platform["linux/arm/v7"].pipod.SourceURL)
+
+	_, errs = parseSpec("pipod.toml", []byte(`[platform.'linux/arm/v7'.labels]
+"com.github.gaboose.pipod.source.url" = "https://example.com/armv7.img.xz"
+
+[platform.'linux/armhf'.labels]
+"com.github.gaboose.pipod.source.url" = "https://example.com/armhf.img.xz"
+
+[platform.'Linux/arm64'.labels]
+"com.github.gaboose.pipod.source.url" = "https://example.com/arm64.img.xz"
+
+[platform.'linux/arm/v9'.labels]
+"com.github.gaboose.pipod.source.url" = "https://example.com/armv9.img.xz"
+`), nil)
+	assert.Equal(t, []string{
+		`pipod.toml:4: platform."linux/armhf": same platform as "linux/arm/v7"`,
+		`pipod.toml:7: platform."Linux/arm64": invalid platform "Linux/arm64": invalid os "Linux"`,
+		`pipod.toml:10: platform."linux/arm/v9": invalid platform "linux/arm/v9": unknown variant "v9" of arm`,
+	}, errorStrings(errs))
+}
+
+func TestParseSpecExtends(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "common.toml"), []byte(`[vars]
+base = "https://example.com"
+
+[labels]
+"org.opencontainers.image.source" = "https://github.com/gaboose/pipod"
+"org.opencontainers.image.vendor" = "gaboose"
+
+[platform.'linux/arm64'.labels]
+"com.github.gaboose.pipod.source.url" = "${base}/arm64.img.xz"
+"com.github.gaboose.pipod.source.partitions.import" = "sda2"
+`), 0644))
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "image"), 0755))
+	spec, errs := parseSpec(filepath.Join(dir, "image", "pipod.toml"), []byte(`extends = "../common.toml"
+
+[vars]
+base = "https://mirror.example.com"
+
+[labels]
+"org.opencontainers.image.vendor" = "me"
+
+[platform.'linux/arm64'.labels]
+"com.github.gaboose.pipod.source.sha256" = "79146135607ffe8acac94e5ff501de6fc49583117de5ad08c45a32c73ae2a027"
+
+[platform.'linux/arm/v7'.labels]
+"com.github.gaboose.pipod.source.url" = "${base}/armhf.img.xz"
+`), nil)
+	require.Empty(t, errs)
+
+	assert.Empty(t, spec.Extends)
+	assert.Equal(t, map[string]string{
+		"org.opencontainers.image.source": "https://github.com/gaboose/pipod",
+		"org.opencontainers.image.vendor": "me",
+	}, spec.Labels)
+	assert.Equal(t, map[string]string{
+		"com.github.gaboose.pipod.source.url":               "https://mirror.example.com/arm64.img.xz",
+		"com.github.gaboose.pipod.source.sha256":            "79146135607ffe8acac94e5ff501de6fc49583117de5ad08c45a32c73ae2a027",
+		"com.github.gaboose.pipod.source.partitions.import": "sda2",
+	}, spec.Platform["linux/arm64"].Labels)
+	assert.Equal(t, "https://mirror.example.com/armhf.img.xz", spec.Platform["linux/arm/v7"].pipod.SourceURL)
+}
+
+func TestParseSpecExtendsErrors(t *testing.T) {
+	dir := t.TempDir()
+	common := filepath.Join(dir, "common.toml")
+	require.NoError(t, os.WriteFile(common, []byte(`[platform.'linux/arm64'.labels]
+"com.github.gaboose.pipod.source.sha256" = "abc"
+`), 0644))
+
+	_, errs := parseSpec(filepath.Join(dir, "pipod.toml"), []byte(`extends = "common.toml"
+
+[platform.'linux/arm64'.labels]
+"com.github.gaboose.pipod.source.url" = "https://example.com/image.img.xz"
+`), nil)
+	assert.Equal(t, []string{
+		common + `:2: platform."linux/arm64".labels."com.github.gaboose.pipod.source.sha256": "abc" is not a sha256 hash`,
+	}, errorStrings(errs))
+
+	require.NoError(t, os.WriteFile(common, []byte(`extends = "pipod.toml"`), 0644))
+	_, errs = parseSpec(filepath.Join(dir, "pipod.toml"), []byte(`extends = "common.toml"`), nil)
+	assert.Equal(t, []string{
+		common + `:1: extends: ` + filepath.Join(dir, "pipod.toml") + ` extends itself`,
+	}, errorStrings(errs))
+
+	_, errs = parseSpec(filepath.Join(dir, "pipod.toml"), []byte(`extends = "missing.toml"`), nil)
+	require.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "pipod.toml:1: extends: failed to read ")
+}
+
+func TestParseSpecProvenanceLabels(t *testing.T) {
+	_, errs := parseSpec("pipod.toml", []byte(`[labels]
+"com.github.gaboose.pipod.build.version" = "v1.0.0"
+
+[platform.'linux/arm64'.labels]
+"com.github.gaboose.pipod.source.url" = "https://example.com/image.img.xz"
+"com.github.gaboose.pipod.source.download.sha256" = "79146135607ffe8acac94e5ff501de6fc49583117de5ad08c45a32c73ae2a027"
+`), nil)
+
+	assert.Equal(t, []string{
+		`pipod.toml:2: labels."com.github.gaboose.pipod.build.version": set by container build`,
+		`pipod.toml:6: platform."linux/arm64".labels."com.github.gaboose.pipod.source.download.sha256": set by container build`,
+	}, errorStrings(errs))
+}
+
+func TestProvenanceSpecSHA256(t *testing.T) {
+	dir := t.TempDir()
+	common := filepath.Join(dir, "common.toml")
+	spec := filepath.Join(dir, "pipod.toml")
+	require.NoError(t, os.WriteFile(spec, []byte(`extends = "common.toml"
+
+[platform.'linux/arm64'.labels]
+"com.github.gaboose.pipod.source.url" = "https://example.com/${suite}.img.xz"
+`), 0644))
+
+	specSHA256 := func(base string, vars map[string]string) string {
+		require.NoError(t, os.WriteFile(common, []byte(base), 0644))
+		cmd := &ContainerBuildCmd{Spec: spec, Set: vars}
+		s, err := loadSpec(cmd.Spec, cmd.Set)
+		require.NoError(t, err)
+		labels, err := cmd.provenance(s)
+		require.NoError(t, err)
+		return labels[labelBuildSpecSHA256]
+	}
+
+	bookworm := specSHA256("[vars]\nsuite = \"bookworm\"\n", nil)
+	assert.Equal(t, bookworm, specSHA256("[vars]\nsuite = \"bookworm\"\n", nil))
+	assert.NotEqual(t, bookworm, specSHA256("[vars]\nsuite = \"trixie\"\n", nil))
+	assert.NotEqual(t, bookworm, specSHA256("[vars]\nsuite = \"bookworm\"\n", map[string]string{"suite": "trixie"}))
+	// the same rendered spec, however it's written
+	assert.Equal(t, bookworm, specSHA256("[vars]\nsuite = \"trixie\"\n", map[string]string{"suite": "bookworm"}))
+}
+
+func TestParseSpecDisk(t *testing.T) {
+	spec, errs := parseSpec("pipod.toml", []byte(`[platform.'linux/arm64'.labels]
+"com.github.gaboose.pipod.source.url" = "https://example.com/image.img.xz"
+
+[disk]
+size = "4G"
+
+[[disk.partition]]
+fstype = "vfat"
+size = "512M"
+label = "bootfs"
+
+[[disk.partition]]
+fstype = "ext4"
+label = "rootfs"
+`), nil)
+	require.Empty(t, errs)
+	assert.Equal(t, &DiskSpec{Size: "4G", Partition: []PartitionSpec{
+		{FSType: "vfat", Size: "512M", Label: "bootfs"},
+		{FSType: "ext4", Label: "rootfs"},
+	}}, spec.Disk)
+
+	_, errs = parseSpec("pipod.toml", []byte(`[platform.'linux/arm64'.labels]
+"com.github.gaboose.pipod.source.url" = "https://example.com/image.img.xz"
+"com.github.gaboose.pipod.disk.layout" = "{}"
+
+[disk]
+[[disk.partition]]
+fstype = "ntfs"
+`), nil)
+	assert.Equal(t, []string{
+		`pipod.toml:3: platform."linux/arm64".labels."com.github.gaboose.pipod.disk.layout": set by container build`,
+		`pipod.toml:5: disk: partition.0.fstype: unknown filesystem "ntfs", expected vfat, ext2, ext3 or ext4`,
+	}, errorStrings(errs))
+}
@@ -1,18 +1,123 @@
 package main
 
 import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+
 	"github.com/alecthomas/kong"
+	"github.com/gaboose/pipod/internal/cache"
+	"github.com/gaboose/pipod/internal/download"
+	"github.com/gaboose/pipod/internal/event"
+	"github.com/gaboose/pipod/internal/guestfish"
+	"github.com/gaboose/pipod/internal/podman"
 )
 
+type Globals struct {
+	Output   string   `enum:"text,json" default:"text" env:"PIPOD_OUTPUT" help:"Output format: text or json (one event per line)"`
+	CacheDir string   `help:"Directory for cached source images (default: $XDG_CACHE_HOME/pipod)" env:"PIPOD_CACHE_DIR" type:"path"`
+	Keyring  []string `help:"Trusted minisign or OpenPGP public key files for verifying source image signatures" env:"PIPOD_KEYRING" type:"path"`
+	Config   string   `help:"Path to the config file (default: $XDG_CONFIG_HOME/pipod/config.toml)" env:"PIPOD_CONFIG" type:"path"`
+	Proxy    string   `help:"Proxy URL for source downloads (default: $HTTPS_PROXY, $HTTP_PROXY)" env:"PIPOD_PROXY"`
+	CABundle string   `help:"PEM file of extra certificate authorities to trust for source downloads" env:"PIPOD_CA_BUNDLE" type:"path"`
+}
+
+func (g *Globals) cache() (*cache.Cache, error) {
+	if g.CacheDir != "" {
+		return cache.New(g.CacheDir), nil
+	}
+	return cache.Default()
+}
+
+// events returns an emitter for the --output format and routes the output of
+// podman and guestfish through it. verbose and parallel only affect the text
+// format.
+func (g *Globals) events(verbose, parallel bool) *event.Emitter {
+	var sink event.Sink
+	if g.Output == "json" {
+		sink = event.NewJSON(os.Stdout)
+	} else {
+		sink = &event.Text{Out: os.Stdout, Err: os.Stderr, Verbose: verbose, Parallel: parallel}
+	}
+
+	events := event.NewEmitter(sink)
+	podman.SetOutput(events.LogWriter("podman", "stdout"), events.LogWriter("podman", "stderr"))
+	guestfish.SetOutput(events.LogWriter("guestfish", "stderr"))
+	return events
+}
+
+func (g *Globals) sourceFetcher(events *event.Emitter) (*sourceFetcher, error) {
+	c, err := g.cache()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := g.httpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return &sourceFetcher{
+		cache:   c,
+		client:  client,
+		keyring: g.Keyring,
+		events:  events,
+		locks:   newKeyLocks(),
+	}, nil
+}
+
+// httpClient returns the client for source downloads, configured by the
+// config file and the command line.
+func (g *Globals) httpClient() (*http.Client, error) {
+	path, required := g.Config, true
+	if path == "" {
+		var err error
+		if path, err = defaultConfigPath(); err != nil {
+			return nil, err
+		}
+		required = false
+	}
+
+	config, err := loadConfig(path, required)
+	if err != nil {
+		return nil, err
+	}
+
+	cc := download.ClientConfig{
+		Proxy:    withDefault(g.Proxy, config.Proxy),
+		CABundle: withDefault(g.CABundle, config.CABundle),
+		Netrc:    config.Netrc,
+		Headers:  map[string]map[string]string{},
+	}
+	for host, hc := range config.Hosts {
+		cc.Headers[host] = hc.Headers
+	}
+
+	return download.NewClient(cc)
+}
+
 type CLI struct {
+	Globals
+
+	Version kong.VersionFlag `help:"Print the version and exit"`
+
 	Container ContainerCmd `cmd:"" help:"Manage container images"`
 	Disk      DiskCmd      `cmd:"" help:"Manage disk images"`
 	Sync      SyncCmd      `cmd:"" help:"Sync a disk image from a tar stream, a container image or another disk image"`
+	Cache     CacheCmd     `cmd:"" help:"Manage cached source images"`
+	Spec      SpecCmd      `cmd:"" help:"Manage build specs"`
 }
 
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
 	var cli CLI
-	ctx := kong.Parse(&cli, kong.Name("pipod"))
-	err := ctx.Run()
-	ctx.FatalIfErrorf(err)
+	kctx := kong.Parse(&cli, kong.Name("pipod"), kong.Vars{"version": pipodVersion(), "defaultPlatformTagTemplate": defaultPlatformTagTemplate}, kong.BindTo(ctx, (*context.Context)(nil)))
+	err := kctx.Run(&cli.Globals)
+	if err != nil && cli.Output == "json" {
+		event.NewEmitter(event.NewJSON(os.Stdout)).Error(err)
+	}
+	kctx.FatalIfErrorf(err)
 }
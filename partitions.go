@@ -0,0 +1,273 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	aferoguestfs "github.com/gaboose/afero-guestfs"
+	"github.com/gaboose/afero-guestfs/libguestfs.org/guestfs"
+	"github.com/gaboose/pipod/internal/guestfish"
+)
+
+// partitionMount is a partition selected by selector, mounted at mountpoint.
+type partitionMount struct {
+	selector   string
+	mountpoint string
+}
+
+// partitionMounts are partitions of a disk image mounted together into one
+// filesystem, sorted so that parents are mounted first.
+type partitionMounts []partitionMount
+
+// parsePartitionMounts parses comma separated selector:mountpoint pairs, e.g.
+// "sda2:/,sda1:/boot/firmware". A selector without a mountpoint is mounted at
+// /. See parsePartitionSelector for selectors.
+func parsePartitionMounts(s string) (partitionMounts, error) {
+	var mounts partitionMounts
+	for _, pair := range strings.Split(s, ",") {
+		selector, mountpoint, ok := strings.Cut(pair, ":")
+		mountpoint = strings.TrimSpace(mountpoint)
+		if !ok {
+			mountpoint = "/"
+		}
+
+		selector, err := parsePartitionSelector(selector)
+		if err != nil {
+			return nil, err
+		}
+		if !path.IsAbs(mountpoint) || path.Clean(mountpoint) != mountpoint {
+			return nil, fmt.Errorf("invalid mountpoint %q of %s, expected an absolute path", mountpoint, selector)
+		}
+
+		for _, other := range mounts {
+			if other.selector == selector {
+				return nil, fmt.Errorf("partition %s is mounted twice", selector)
+			}
+			if other.mountpoint == mountpoint {
+				return nil, fmt.Errorf("more than one partition is mounted at %s", mountpoint)
+			}
+		}
+		mounts = append(mounts, partitionMount{selector: selector, mountpoint: mountpoint})
+	}
+
+	if !slices.ContainsFunc(mounts, func(m partitionMount) bool { return m.mountpoint == "/" }) {
+		return nil, fmt.Errorf("no partition is mounted at /")
+	}
+
+	// a parent path is shorter than the paths under it
+	slices.SortStableFunc(mounts, func(a, b partitionMount) int {
+		return cmp.Compare(len(a.mountpoint), len(b.mountpoint))
+	})
+
+	return mounts, nil
+}
+
+// String formats mounts the way parsePartitionMounts parses them.
+func (mounts partitionMounts) String() string {
+	pairs := make([]string, len(mounts))
+	for i, m := range mounts {
+		pairs[i] = m.selector + ":" + m.mountpoint
+	}
+	return strings.Join(pairs, ",")
+}
+
+// resolve returns the partition devices of the selectors in parts.
+func (mounts partitionMounts) resolve(parts []partitionLayout) ([]guestfish.Mount, error) {
+	var resolved []guestfish.Mount
+	for _, m := range mounts {
+		device, err := selectPartition(m.selector, parts)
+		if err != nil {
+			return nil, err
+		}
+
+		for j, other := range resolved {
+			if other.Device == device {
+				return nil, fmt.Errorf("%s and %s both select %s", mounts[j].selector, m.selector, device)
+			}
+		}
+		resolved = append(resolved, guestfish.Mount{Device: device, Mountpoint: m.mountpoint})
+	}
+	return resolved, nil
+}
+
+// resolveImage returns the partition devices of the selectors in image. It
+// only inspects the image if a selector isn't a device name.
+func (mounts partitionMounts) resolveImage(image string) ([]guestfish.Mount, error) {
+	if !slices.ContainsFunc(mounts, func(m partitionMount) bool { return !isPartitionDevice(m.selector) }) {
+		return mounts.resolve(nil)
+	}
+
+	layout, err := readImageLayout(image)
+	if err != nil {
+		return nil, err
+	}
+
+	return mounts.resolve(layout.Partitions)
+}
+
+var (
+	partitionDeviceRegexp = regexp.MustCompile(`^[a-z][a-z0-9]*$`)
+
+	// partitionSelectors return the value of a partition selected by the
+	// keys of selectors.
+	partitionSelectors = map[string]func(partitionLayout) string{
+		"label":    func(p partitionLayout) string { return p.Label },
+		"uuid":     func(p partitionLayout) string { return p.UUID },
+		"partuuid": func(p partitionLayout) string { return p.PartUUID },
+		"fstype":   func(p partitionLayout) string { return p.FSType },
+	}
+)
+
+// parsePartitionSelector parses a partition device name, e.g. sda2, or a
+// selector: label=NAME, uuid=UUID, partuuid=PARTUUID, fstype=TYPE or largest.
+func parsePartitionSelector(s string) (string, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "/dev/")
+
+	if key, value, ok := strings.Cut(s, "="); ok {
+		if _, ok := partitionSelectors[key]; !ok {
+			return "", fmt.Errorf("invalid partition selector %q, expected one of label=, uuid=, partuuid=, fstype= or largest", s)
+		}
+		if value == "" {
+			return "", fmt.Errorf("invalid partition selector %q, %s is empty", s, key)
+		}
+		return s, nil
+	}
+
+	if s != "largest" && !partitionDeviceRegexp.MatchString(s) {
+		return "", fmt.Errorf("invalid partition device %q", s)
+	}
+
+	return s, nil
+}
+
+// isPartitionDevice reports whether selector is a device name rather than a
+// selector that needs the partition table.
+func isPartitionDevice(selector string) bool {
+	return selector != "largest" && !strings.Contains(selector, "=")
+}
+
+// selectPartition returns the device of the partition in parts selected by
+// selector. A selector must select exactly one partition.
+func selectPartition(selector string, parts []partitionLayout) (string, error) {
+	if isPartitionDevice(selector) {
+		return "/dev/" + selector, nil
+	}
+
+	var matches []string
+	if selector == "largest" {
+		// an extended partition spans its logical partitions but holds no
+		// filesystem itself
+		parts = slices.DeleteFunc(slices.Clone(parts), func(p partitionLayout) bool { return p.FSType == "" })
+		if len(parts) > 0 {
+			largest := slices.MaxFunc(parts, func(a, b partitionLayout) int { return cmp.Compare(a.Size, b.Size) })
+			matches = append(matches, largest.Device)
+		}
+	} else {
+		key, value, _ := strings.Cut(selector, "=")
+		for _, part := range parts {
+			if strings.EqualFold(partitionSelectors[key](part), value) {
+				matches = append(matches, part.Device)
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no partition matches %s", selector)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("partitions %s all match %s", strings.Join(matches, ", "), selector)
+	}
+}
+
+// launchGuestfs launches a libguestfs appliance with image added.
+func launchGuestfs(image string, readonly bool) (*guestfs.Guestfs, error) {
+	g, err := guestfs.Create()
+	if err != nil {
+		return nil, fmt.Errorf("create failed: %w", err)
+	}
+
+	var opts *guestfs.OptargsAdd_drive
+	if readonly {
+		opts = &guestfs.OptargsAdd_drive{Readonly_is_set: true, Readonly: true}
+	}
+
+	if err := g.Add_drive(image, opts); err != nil {
+		g.Close()
+		return nil, fmt.Errorf("add drive failed: %w", err)
+	}
+
+	if err := g.Launch(); err != nil {
+		g.Close()
+		return nil, fmt.Errorf("launch failed: %w", err)
+	}
+
+	return g, nil
+}
+
+// partitionsFs is the filesystem of partitions of a disk image mounted
+// together.
+type partitionsFs struct {
+	*aferoguestfs.Fs
+	inner *guestfs.Guestfs
+
+	// layout is the partition layout of the image
+	layout *diskLayout
+	// mounts are the partition devices mounted
+	mounts []guestfish.Mount
+}
+
+// openPartitionsFs mounts the partitions of image at their mountpoints.
+func openPartitionsFs(image string, mounts partitionMounts) (*partitionsFs, error) {
+	g, err := launchGuestfs(image, false)
+	if err != nil {
+		return nil, err
+	}
+
+	layout, err := readDiskLayout(g)
+	if err != nil {
+		g.Close()
+		return nil, err
+	}
+
+	resolved, err := mounts.resolve(layout.Partitions)
+	if err != nil {
+		g.Close()
+		return nil, err
+	}
+
+	for _, m := range resolved {
+		if err := g.Mount(m.Device, m.Mountpoint); err != nil {
+			g.Close()
+			return nil, fmt.Errorf("failed to mount partition %s at %s: %w", m.Device, m.Mountpoint, err)
+		}
+	}
+
+	return &partitionsFs{Fs: aferoguestfs.New(g), inner: g, layout: layout, mounts: resolved}, nil
+}
+
+// root returns the partition device mounted at /.
+func (p *partitionsFs) root() string {
+	for _, m := range p.mounts {
+		if m.Mountpoint == "/" {
+			return m.Device
+		}
+	}
+	return ""
+}
+
+// Close unmounts the partitions, writing all changes to the image.
+func (p *partitionsFs) Close() error {
+	if err := p.inner.Umount_all(); err != nil {
+		return fmt.Errorf("umount all failed: %w", err)
+	}
+	if err := p.inner.Close(); err != nil {
+		return fmt.Errorf("guestfs close failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gaboose/pipod/internal/guestfish"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePartitionMounts(t *testing.T) {
+	mounts, err := parsePartitionMounts("sda2")
+	require.NoError(t, err)
+	assert.Equal(t, partitionMounts{{selector: "sda2", mountpoint: "/"}}, mounts)
+
+	mounts, err = parsePartitionMounts(" label=bootfs:/boot/firmware , /dev/sda2:/ ")
+	require.NoError(t, err)
+	assert.Equal(t, partitionMounts{
+		{selector: "sda2", mountpoint: "/"},
+		{selector: "label=bootfs", mountpoint: "/boot/firmware"},
+	}, mounts)
+	assert.Equal(t, "sda2:/,label=bootfs:/boot/firmware", mounts.String())
+
+	mounts, err = parsePartitionMounts("sda3:/boot/firmware/overlays,sda1:/boot,largest:/")
+	require.NoError(t, err)
+	assert.Equal(t, "largest:/,sda1:/boot,sda3:/boot/firmware/overlays", mounts.String())
+
+	for s, msg := range map[string]string{
+		"sda1:/boot":             "no partition is mounted at /",
+		"sda2:/,":                `invalid partition device ""`,
+		"sda2:/,sda1:boot":       `invalid mountpoint "boot" of sda1, expected an absolute path`,
+		"sda2:/,sda1:/boot/":     `invalid mountpoint "/boot/" of sda1, expected an absolute path`,
+		"sda2:/,sda2:/boot":      "partition sda2 is mounted twice",
+		"sda2:/,sda1:/":          "more than one partition is mounted at /",
+		"sda2:/,SDA1:/boot":      `invalid partition device "SDA1"`,
+		"sda2:/,sda1:/boot/../x": `invalid mountpoint "/boot/../x" of sda1, expected an absolute path`,
+		"name=rootfs":            `invalid partition selector "name=rootfs", expected one of label=, uuid=, partuuid=, fstype= or largest`,
+		"label=":                 `invalid partition selector "label=", label is empty`,
+	} {
+		_, err := parsePartitionMounts(s)
+		assert.EqualError(t, err, msg, s)
+	}
+}
+
+func TestPartitionMountsResolve(t *testing.T) {
+	parts := []partitionLayout{
+		{Device: "/dev/sda1", Size: 512 << 20, Label: "bootfs", FSType: "vfat", PartUUID: "a1b2c3d4-01"},
+		{Device: "/dev/sda2", Size: 4 << 30, Label: "rootfs", FSType: "ext4", PartUUID: "a1b2c3d4-02"},
+		{Device: "/dev/sda3", Size: 2 << 30, Label: "data", FSType: "ext4", PartUUID: "a1b2c3d4-03"},
+		{Device: "/dev/sda4", Size: 1 << 20},
+	}
+
+	resolve := func(s string) ([]guestfish.Mount, error) {
+		mounts, err := parsePartitionMounts(s)
+		require.NoError(t, err)
+		return mounts.resolve(parts)
+	}
+
+	_, err := resolve("label=rootfs:/,partuuid=A1B2C3D4-01:/boot/firmware,fstype=ext4:/data")
+	assert.EqualError(t, err, "partitions /dev/sda2, /dev/sda3 all match fstype=ext4")
+
+	devices, err := resolve("label=rootfs:/,partuuid=A1B2C3D4-01:/boot/firmware,label=data:/data")
+	require.NoError(t, err)
+	assert.Equal(t, []guestfish.Mount{
+		{Device: "/dev/sda2", Mountpoint: "/"},
+		{Device: "/dev/sda3", Mountpoint: "/data"},
+		{Device: "/dev/sda1", Mountpoint: "/boot/firmware"},
+	}, devices)
+
+	devices, err = resolve("largest:/,sda1:/boot/firmware")
+	require.NoError(t, err)
+	assert.Equal(t, []guestfish.Mount{
+		{Device: "/dev/sda2", Mountpoint: "/"},
+		{Device: "/dev/sda1", Mountpoint: "/boot/firmware"},
+	}, devices)
+
+	_, err = resolve("label=rootfs:/,partuuid=A1B2C3D4-01:/boot/firmware,fstype=vfat:/boot")
+	assert.EqualError(t, err, "fstype=vfat and partuuid=A1B2C3D4-01 both select /dev/sda1")
+
+	_, err = resolve("label=missing")
+	assert.EqualError(t, err, "no partition matches label=missing")
+
+	// the extended partition of an msdos disk with logical partitions
+	extended := append(parts, partitionLayout{Device: "/dev/sda4", Size: 8 << 30}, partitionLayout{Device: "/dev/sda5", Size: 1 << 30, FSType: "ext4"})
+	device, err := selectPartition("largest", extended)
+	require.NoError(t, err)
+	assert.Equal(t, "/dev/sda2", device)
+}
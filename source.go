@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gaboose/pipod/internal/cache"
+	"github.com/gaboose/pipod/internal/download"
+	"github.com/gaboose/pipod/internal/event"
+	"github.com/gaboose/pipod/internal/iio"
+	"github.com/gaboose/pipod/internal/podman"
+	"github.com/gaboose/pipod/internal/verify"
+	"github.com/mholt/archives"
+)
+
+// sourceFetcher downloads, verifies and decompresses source images into the
+// cache.
+type sourceFetcher struct {
+	cache   *cache.Cache
+	client  *http.Client
+	keyring []string
+	events  *event.Emitter
+	locks   *keyLocks
+	// dir is the directory that source URLs that are relative paths are
+	// resolved against, that of the build spec. They are resolved against
+	// the working directory if it's empty.
+	dir string
+}
+
+// keyLocks serialises the fetches of a cache entry by the platform builds of
+// one command, which may share a source image.
+type keyLocks struct {
+	mu     sync.Mutex
+	locks  map[string]*sync.Mutex
+	forced map[string]bool
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{locks: map[string]*sync.Mutex{}, forced: map[string]bool{}}
+}
+
+// lock locks key and returns its unlock function.
+func (k *keyLocks) lock(key string) func() {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		k.locks[key] = l
+	}
+	k.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// force reports whether key is to be downloaded again. It is only the first
+// time, so that a forced download isn't removed by the next build using it.
+// key must be locked.
+func (k *keyLocks) force(key string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.forced[key] {
+		return false
+	}
+	k.forced[key] = true
+	return true
+}
+
+// withPlatform returns a copy of sf that tags its events with platform.
+func (sf *sourceFetcher) withPlatform(platform string) *sourceFetcher {
+	cp := *sf
+	cp.events = sf.events.WithPlatform(platform)
+	return &cp
+}
+
+// fetch makes sure the source image of labels is in the cache and returns its
+// entry. The download is skipped when the cache already holds the image,
+// unless force is set. The entry is locked for reading and must be unlocked
+// once its image is no longer read.
+func (sf *sourceFetcher) fetch(ctx context.Context, labels PipodLabels, force bool) (*cache.Entry, error) {
+	labels = labels.resolve(sf.dir)
+	url := labels.SourceURL
+	d := sf.newDownloader()
+
+	if labels.SourceSignatureURL != "" && len(sf.keyring) == 0 {
+		return nil, fmt.Errorf("%s has a signature, pass its trusted public key with --keyring", url)
+	}
+
+	sha256Sum, err := sf.expectedSHA256(ctx, d, labels)
+	if err != nil {
+		return nil, err
+	}
+
+	var key, etag string
+	if sha256Sum != "" {
+		key = cache.KeySHA256(sha256Sum)
+	} else {
+		if etag, err = d.ETagFirst(ctx, labels.GetSourceURLs()); err != nil {
+			return nil, fmt.Errorf("failed to get etag of %s: %w", url, err)
+		}
+		key = cache.KeyURL(url, etag)
+	}
+
+	unlock := sf.locks.lock(key)
+	defer unlock()
+	force = force && sf.locks.force(key)
+
+	entry, err := sf.cache.Entry(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cache entry: %w", err)
+	}
+
+	if err := entry.Lock(false); err != nil {
+		return nil, fmt.Errorf("failed to lock cache entry: %w", err)
+	}
+
+	if force || !entry.Complete() {
+		if err := sf.fill(ctx, d, entry, labels, sha256Sum, etag, force); err != nil {
+			entry.Unlock()
+			return nil, err
+		}
+		return entry, nil
+	}
+
+	if err := sf.useCached(ctx, d, entry, labels); err != nil {
+		entry.Unlock()
+		return nil, err
+	}
+	return entry, nil
+}
+
+// useCached verifies the cached source of entry against the signature of
+// labels, which the entry may have been filled without, and marks it used.
+func (sf *sourceFetcher) useCached(ctx context.Context, d *download.Downloader, entry *cache.Entry, labels PipodLabels) error {
+	sf.events.Info("Using cached %s", labels.SourceURL)
+
+	if labels.SourceSignatureURL != "" {
+		sf.events.Start(event.PhaseVerify, "Verifying signature %s...", labels.SourceSignatureURL)
+		if err := sf.verifySignature(ctx, d, entry, labels.SourceSignatureURL); err != nil {
+			return fmt.Errorf("cached %s: %w", labels.SourceURL, err)
+		}
+		sf.events.End(event.PhaseVerify)
+	}
+
+	if err := entry.Touch(); err != nil {
+		return fmt.Errorf("failed to update cache entry: %w", err)
+	}
+	return nil
+}
+
+// fill downloads, verifies and decompresses the source of labels into entry
+// under an exclusive lock, and then locks entry for reading again.
+func (sf *sourceFetcher) fill(ctx context.Context, d *download.Downloader, entry *cache.Entry, labels PipodLabels, sha256Sum, etag string, force bool) error {
+	url := labels.SourceURL
+
+	if err := entry.Lock(true); err != nil {
+		return fmt.Errorf("failed to lock cache entry: %w", err)
+	}
+
+	// another process may have filled the entry while this one waited
+	if !force && entry.Complete() {
+		if err := sf.useCached(ctx, d, entry, labels); err != nil {
+			return err
+		}
+		return entry.Lock(false)
+	}
+
+	if force {
+		if err := entry.Remove(); err != nil {
+			return fmt.Errorf("failed to remove cache entry: %w", err)
+		}
+	}
+	if err := entry.Prepare(); err != nil {
+		return fmt.Errorf("failed to prepare cache entry: %w", err)
+	}
+
+	if _, err := os.Stat(entry.SourcePath()); err == nil {
+		sf.events.Info("Skipping the download step: %s was downloaded before", url)
+	} else {
+		sf.events.Start(event.PhaseDownload, "Downloading %s...", url)
+		tracker := sf.events.Progress(event.PhaseDownload, 0)
+		d.Progress = tracker.Set
+		fetched, err := d.FetchFirst(ctx, labels.GetSourceURLs(), entry.SourcePath())
+		tracker.Close()
+		if err != nil {
+			return fmt.Errorf("failed to download %s: %w", url, err)
+		}
+		if fetched != url {
+			sf.events.Info("Downloaded from mirror %s", fetched)
+		}
+	}
+
+	if labels.SourceSignatureURL != "" {
+		sf.events.Start(event.PhaseVerify, "Verifying signature %s...", labels.SourceSignatureURL)
+		if err := sf.verifySignature(ctx, d, entry, labels.SourceSignatureURL); err != nil {
+			os.Remove(entry.SourcePath())
+			return fmt.Errorf("%s: %w", url, err)
+		}
+		sf.events.End(event.PhaseVerify)
+	}
+
+	meta, err := sf.decompress(ctx, entry, labels, sha256Sum)
+	if err != nil {
+		if ctx.Err() == nil {
+			// the source may be corrupt, truncated or an error page, don't
+			// reuse or resume from it next time
+			os.Remove(entry.SourcePath())
+		}
+		return err
+	}
+	meta.URL = url
+	meta.ETag = etag
+
+	if err := entry.Commit(meta); err != nil {
+		return fmt.Errorf("failed to commit cache entry: %w", err)
+	}
+
+	return entry.Lock(false)
+}
+
+// expectedSHA256 returns the sha256 hash of the source from its label or its
+// published checksum file. It returns an empty string if neither is set.
+func (sf *sourceFetcher) expectedSHA256(ctx context.Context, d *download.Downloader, labels PipodLabels) (string, error) {
+	if labels.SourceSHA256URL == "" {
+		return strings.ToLower(labels.SourceSHA256), nil
+	}
+
+	data, err := d.ReadFile(ctx, labels.SourceSHA256URL)
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s: %w", labels.SourceSHA256URL, err)
+	}
+
+	sum, err := verify.ParseChecksumFile(data, labels.SourceURL)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", labels.SourceSHA256URL, err)
+	}
+
+	if labels.SourceSHA256 != "" && !strings.EqualFold(labels.SourceSHA256, sum) {
+		return "", fmt.Errorf("%s: checksum %s does not match com.github.gaboose.pipod.source.sha256 %s", labels.SourceSHA256URL, sum, labels.SourceSHA256)
+	}
+
+	return sum, nil
+}
+
+func (sf *sourceFetcher) verifySignature(ctx context.Context, d *download.Downloader, entry *cache.Entry, sigURL string) error {
+	sig, err := d.ReadFile(ctx, sigURL)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", sigURL, err)
+	}
+
+	if err := verify.Signature(sf.keyring, sig, entry.SourcePath()); err != nil {
+		return fmt.Errorf("signature verification failed: %w", err)
+	}
+
+	return nil
+}
+
+// newDownloader returns a downloader that reports retries as info events.
+func (sf *sourceFetcher) newDownloader() *download.Downloader {
+	d := download.NewWithClient(sf.client)
+	d.Log = sf.events.Info
+	d.Register("oci", podman.ArtifactTransport{})
+	return d
+}
+
+// decompress verifies the downloaded source file of entry and decompresses it
+// into the entry image. If the source is an archive, the image is extracted
+// from the member matching com.github.gaboose.pipod.source.archive.member.
+func (sf *sourceFetcher) decompress(ctx context.Context, entry *cache.Entry, labels PipodLabels, sha256Sum string) (cache.Meta, error) {
+	f, err := os.Open(entry.SourcePath())
+	if err != nil {
+		return cache.Meta{}, fmt.Errorf("failed to open %s: %w", entry.SourcePath(), err)
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return cache.Meta{}, fmt.Errorf("failed to stat %s: %w", entry.SourcePath(), err)
+	}
+
+	format, _, err := archives.Identify(ctx, labels.SourceURL, f)
+	if err != nil && !errors.Is(err, archives.NoMatch) {
+		return cache.Meta{}, fmt.Errorf("failed to identify compression: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return cache.Meta{}, fmt.Errorf("failed to seek %s: %w", entry.SourcePath(), err)
+	}
+
+	extractor, isArchive := format.(archives.Extractor)
+	if labels.SourceArchiveMember != "" && !isArchive {
+		return cache.Meta{}, fmt.Errorf("%s: com.github.gaboose.pipod.source.archive.member is set but the source is not an archive", labels.SourceURL)
+	}
+
+	// archives are verified in a pass of their own, everything else while
+	// decompressing
+	phase := event.PhaseDecompress
+	if isArchive {
+		phase = event.PhaseVerify
+		sf.events.Start(phase, "Verifying %s...", labels.SourceURL)
+	} else {
+		sf.events.Start(phase, "Decompressing %s...", labels.SourceURL)
+	}
+
+	h := sha256.New()
+	var rc io.ReadCloser = io.NopCloser(iio.ContextReader(ctx, f))
+	rc = progress(rc, sf.events.Progress(phase, st.Size()))
+	if sha256Sum != "" {
+		rc = verifier(rc, h, sha256Sum)
+	} else {
+		rc = iio.Closer(rc.Close).WithReader(io.TeeReader(rc, h))
+	}
+	if labels.SourceSHA512 != "" {
+		rc = verifier(rc, sha512.New(), labels.SourceSHA512)
+	}
+
+	imagePart := entry.ImagePath() + ".part"
+	if isArchive {
+		// archives may need random access, so the whole file is verified
+		// before extracting from it
+		_, err = io.Copy(io.Discard, rc)
+		rc.Close()
+		if err == nil {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+		if err == nil {
+			err = extractMember(ctx, extractor, f, labels.GetSourceArchiveMember(), imagePart, sf.events)
+		}
+	} else {
+		err = save(decompresser(rc, labels.SourceURL), imagePart)
+	}
+	if err != nil {
+		return cache.Meta{}, fmt.Errorf("%s: %w", labels.SourceURL, err)
+	}
+
+	imageSt, err := os.Stat(imagePart)
+	if err != nil {
+		return cache.Meta{}, fmt.Errorf("failed to stat %s: %w", imagePart, err)
+	}
+
+	if err := os.Rename(imagePart, entry.ImagePath()); err != nil {
+		return cache.Meta{}, fmt.Errorf("failed to rename: %w", err)
+	}
+
+	return cache.Meta{
+		SHA256:    hex.EncodeToString(h.Sum(nil)),
+		Size:      st.Size(),
+		ImageSize: imageSt.Size(),
+	}, nil
+}
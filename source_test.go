@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gaboose/pipod/internal/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestFetchSharedSource(t *testing.T) {
+	image := bytes.Repeat([]byte("disk image"), 1<<12)
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, err := gw.Write(image)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	var gets atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Method == http.MethodGet {
+			gets.Add(1)
+			// keep the download going while the other platform fetches
+			time.Sleep(50 * time.Millisecond)
+		}
+		http.ServeContent(w, r, "raspios.img.gz", time.Time{}, bytes.NewReader(gz.Bytes()))
+	}))
+	defer srv.Close()
+
+	// e.g. linux/arm/v6 and linux/arm/v7 built from the one armhf image
+	sf := &sourceFetcher{cache: cache.New(t.TempDir()), client: srv.Client(), events: discardEvents, locks: newKeyLocks()}
+	labels := PipodLabels{SourceURL: srv.URL + "/raspios.img.gz"}
+
+	for _, force := range []bool{false, true} {
+		gets.Store(0)
+		entries := make([]*cache.Entry, 2)
+		var g errgroup.Group
+		for i, platform := range []string{"linux/arm/v6", "linux/arm/v7"} {
+			platformSf := sf.withPlatform(platform)
+			g.Go(func() error {
+				var err error
+				entries[i], err = platformSf.fetch(context.Background(), labels, force)
+				if err == nil {
+					entries[i].Unlock()
+				}
+				return err
+			})
+		}
+		require.NoError(t, g.Wait())
+
+		assert.Equal(t, int32(1), gets.Load(), "force=%v", force)
+		assert.Equal(t, entries[0].Dir, entries[1].Dir)
+		got, err := os.ReadFile(entries[0].ImagePath())
+		require.NoError(t, err)
+		assert.Equal(t, image, got)
+
+		// as in the next command
+		sf.locks = newKeyLocks()
+	}
+}
+
+func TestFetchCorruptSource(t *testing.T) {
+	image := bytes.Repeat([]byte("disk image"), 1<<12)
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, err := gw.Write(image)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	// an error page served with a success status
+	body := []byte("<html>Service Unavailable</html>")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "raspios.img.gz", time.Time{}, bytes.NewReader(body))
+	}))
+	defer srv.Close()
+
+	c := cache.New(t.TempDir())
+	sf := &sourceFetcher{cache: c, client: srv.Client(), events: discardEvents, locks: newKeyLocks()}
+	labels := PipodLabels{SourceURL: srv.URL + "/raspios.img.gz"}
+
+	_, err = sf.fetch(context.Background(), labels, false)
+	require.Error(t, err)
+
+	entries, err := c.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.NoFileExists(t, entries[0].SourcePath())
+
+	// the next fetch downloads again rather than reusing the error page
+	body = gz.Bytes()
+	entry, err := sf.fetch(context.Background(), labels, false)
+	require.NoError(t, err)
+	defer entry.Unlock()
+	got, err := os.ReadFile(entry.ImagePath())
+	require.NoError(t, err)
+	assert.Equal(t, image, got)
+}
+
+func TestFetchRelativeSource(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "images"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "images", "raspios.img"), []byte("disk image"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pipod.toml"), []byte(`[platform.'linux/arm64'.labels]
+"com.github.gaboose.pipod.source.url" = "images/raspios.img"
+"com.github.gaboose.pipod.source.mirrors" = "missing.img, images/raspios.img"
+`), 0644))
+
+	spec, err := loadSpec(filepath.Join(dir, "pipod.toml"), nil)
+	require.NoError(t, err)
+	platform := spec.Platform["linux/arm64"]
+	labels := platform.pipod
+	// the spec is kept as written, and images record absolute URLs
+	assert.Equal(t, "images/raspios.img", labels.SourceURL)
+	assert.Equal(t, map[string]string{
+		labelSourceURL:     "file://" + filepath.Join(dir, "images", "raspios.img"),
+		labelSourceMirrors: "file://" + filepath.Join(dir, "missing.img") + ",file://" + filepath.Join(dir, "images", "raspios.img"),
+	}, platform.resolvedLabels(dir))
+
+	sf := &sourceFetcher{cache: cache.New(t.TempDir()), client: http.DefaultClient, events: discardEvents, locks: newKeyLocks(), dir: dir}
+	entry, err := sf.fetch(context.Background(), labels, false)
+	require.NoError(t, err)
+	defer entry.Unlock()
+	got, err := os.ReadFile(entry.ImagePath())
+	require.NoError(t, err)
+	assert.Equal(t, "disk image", string(got))
+	assert.Equal(t, "images/raspios.img", labels.SourceURL)
+
+	assert.Equal(t, PipodLabels{
+		SourceURL:     "file://" + filepath.Join(dir, "images", "raspios.img"),
+		SourceMirrors: "file://" + filepath.Join(dir, "missing.img") + ",file://" + filepath.Join(dir, "images", "raspios.img"),
+	}, labels.resolve(dir))
+}
+
+func TestFetchCachedSourceSignature(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "raspios.img"), []byte("disk image"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "raspios.img.minisig"), []byte("not a signature"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "trusted.pub"), []byte("not a key"), 0644))
+
+	sf := &sourceFetcher{cache: cache.New(t.TempDir()), client: http.DefaultClient, events: discardEvents, locks: newKeyLocks(), dir: dir}
+	labels := PipodLabels{SourceURL: "raspios.img"}
+	entry, err := sf.fetch(context.Background(), labels, false)
+	require.NoError(t, err)
+	entry.Unlock()
+
+	// a signature added to a spec whose source is cached already
+	sf.keyring = []string{filepath.Join(dir, "trusted.pub")}
+	labels.SourceSignatureURL = "raspios.img.minisig"
+	_, err = sf.fetch(context.Background(), labels, false)
+	assert.ErrorContains(t, err, "signature verification failed")
+}
@@ -1,33 +1,119 @@
 package main
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
+	"maps"
+	"os"
 )
 
 type PlatformSpec struct {
-	Labels PipodLabels `toml:"labels"`
+	Labels map[string]string `toml:"labels"`
+
+	// pipod holds the com.github.gaboose.pipod.* labels, parsed by parseSpec.
+	pipod PipodLabels
 }
 
-func (ps *PlatformSpec) validate() error {
-	return ps.Labels.validate()
+// resolvedLabels returns the labels of ps with source URLs that are plain
+// paths resolved against dir. Images record these, so that disk build finds
+// the source wherever it runs.
+func (ps *PlatformSpec) resolvedLabels(dir string) map[string]string {
+	resolved := ps.pipod.resolve(dir)
+	labels := maps.Clone(ps.Labels)
+	for label, u := range map[string]string{
+		labelSourceURL:          resolved.SourceURL,
+		labelSourceMirrors:      resolved.SourceMirrors,
+		labelSourceSHA256URL:    resolved.SourceSHA256URL,
+		labelSourceSignatureURL: resolved.SourceSignatureURL,
+	} {
+		if _, ok := labels[label]; ok {
+			labels[label] = u
+		}
+	}
+	return labels
 }
 
 type Spec struct {
+	// Extends is the path of a base spec, relative to this one.
+	Extends string `toml:"extends,omitempty"`
+	// Vars are substituted for ${name} in label values.
+	Vars map[string]string `toml:"vars,omitempty"`
+	// Update finds the variables of the newest release, see
+	// pipod spec update.
+	Update   []UpdateStep            `toml:"update,omitempty"`
 	Labels   map[string]string       `toml:"labels"`
 	Platform map[string]PlatformSpec `toml:"platform"`
+	// Disk is the partition layout of disk images built from scratch, see
+	// pipod disk build --from-scratch.
+	Disk *DiskSpec `toml:"disk,omitempty"`
+}
+
+// UpdateStep finds the newest release listed on an index page.
+type UpdateStep struct {
+	// Index is the URL of the page. Variables are substituted, including
+	// those found by previous steps.
+	Index string `toml:"index"`
+	// Match is a regular expression matched against the links of the page.
+	// Its named groups set the variables of the same name. Variables are
+	// substituted and match their values literally.
+	Match string `toml:"match"`
 }
 
-func (s *Spec) validate() error {
-	if len(s.Platform) == 0 {
-		return fmt.Errorf(`"platform" is empty`)
+// extend returns the spec child merged into s. Vars and labels of child
+// replace those of s with the same name. Platforms of both are built, and
+// the labels of a platform in both are merged the same way. Update steps of
+// child replace all of those of s, and so does its disk.
+func (s *Spec) extend(child *Spec) *Spec {
+	merged := &Spec{
+		Vars:     mergeMaps(s.Vars, child.Vars),
+		Update:   s.Update,
+		Labels:   mergeMaps(s.Labels, child.Labels),
+		Platform: map[string]PlatformSpec{},
+		Disk:     cmp.Or(child.Disk, s.Disk),
+	}
+	if len(child.Update) > 0 {
+		merged.Update = child.Update
 	}
 
 	for name, platform := range s.Platform {
-		if err := platform.validate(); err != nil {
-			return fmt.Errorf(`platform.%s.labels: %w`, name, err)
+		merged.Platform[name] = PlatformSpec{Labels: mergeMaps(platform.Labels, child.Platform[name].Labels)}
+	}
+	for name, platform := range child.Platform {
+		if _, ok := s.Platform[name]; !ok {
+			merged.Platform[name] = PlatformSpec{Labels: mergeMaps(platform.Labels)}
 		}
-		s.Platform[name] = platform
 	}
 
-	return nil
+	return merged
+}
+
+// mergeMaps returns a new map with the entries of all ms, later ones taking
+// precedence.
+func mergeMaps(ms ...map[string]string) map[string]string {
+	var merged map[string]string
+	for _, m := range ms {
+		if len(m) > 0 && merged == nil {
+			merged = map[string]string{}
+		}
+		maps.Copy(merged, m)
+	}
+	return merged
+}
+
+// loadSpec reads and validates the build spec at path. vars override the
+// variables of the spec. URLs that are plain paths are kept as written, and
+// resolved against the directory of the spec when fetched.
+func loadSpec(path string, vars map[string]string) (*Spec, error) {
+	tomlBts, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read toml: %w", err)
+	}
+
+	spec, errs := parseSpec(path, tomlBts, vars)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return spec, nil
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/gaboose/pipod/internal/platform"
+)
+
+// defaultPlatformTagTemplate names the images of multi-platform builds, e.g.
+// myimage:latest-armv7.
+const defaultPlatformTagTemplate = "{{.Repo}}:{{.Tag}}-{{.Arch}}{{.Variant}}"
+
+// platformTag is what --platform-tag-template is executed with.
+type platformTag struct {
+	Repo    string
+	Tag     string
+	OS      string
+	Arch    string
+	Variant string
+}
+
+// platformTags returns the tags of the image of every platform, made by
+// executing text on every tag in order. Every platform must get its own tags.
+func platformTags(text string, tags []string, platformNames []string) (map[string][]string, error) {
+	tmpl, err := template.New("platform-tag").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid platform tag template: %w", err)
+	}
+
+	// tags of the manifest, with a tag
+	var manifestTags []string
+	for _, tag := range tags {
+		repo, t := splitTag(tag)
+		manifestTags = append(manifestTags, repo+":"+t)
+	}
+
+	ret := map[string][]string{}
+	tagged := map[string]string{}
+	for _, name := range platformNames {
+		p, err := platform.Parse(name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, tag := range tags {
+			repo, t := splitTag(tag)
+
+			var b strings.Builder
+			err := tmpl.Execute(&b, platformTag{Repo: repo, Tag: t, OS: p.OS, Arch: p.Arch, Variant: p.Variant})
+			if err != nil {
+				return nil, fmt.Errorf("failed to execute platform tag template: %w", err)
+			}
+
+			executed := b.String()
+			if repo, t := splitTag(executed); slices.Contains(manifestTags, repo+":"+t) {
+				return nil, fmt.Errorf("platform %s is tagged %s, which is a tag of the manifest", name, executed)
+			}
+			if other, ok := tagged[executed]; ok && other != name {
+				return nil, fmt.Errorf("platforms %s and %s are both tagged %s, set a --platform-tag-template that tells them apart", other, name, executed)
+			}
+			tagged[executed] = name
+
+			if !slices.Contains(ret[name], executed) {
+				ret[name] = append(ret[name], executed)
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// splitTag splits a tagged name into its repository and tag. The tag is
+// latest if name has none.
+func splitTag(name string) (repo, tag string) {
+	i := strings.LastIndex(name, ":")
+	// the colon of a registry port, e.g. localhost:5000/image
+	if i < 0 || strings.Contains(name[i:], "/") {
+		return name, "latest"
+	}
+	return name[:i], name[i+1:]
+}
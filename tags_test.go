@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlatformTags(t *testing.T) {
+	platforms := []string{"linux/arm/v6", "linux/arm/v7", "linux/arm64"}
+
+	tags, err := platformTags(defaultPlatformTagTemplate, []string{"raspios", "ghcr.io/gaboose/raspios:trixie", "localhost:5000/raspios"}, platforms)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"linux/arm/v6": {"raspios:latest-armv6", "ghcr.io/gaboose/raspios:trixie-armv6", "localhost:5000/raspios:latest-armv6"},
+		"linux/arm/v7": {"raspios:latest-armv7", "ghcr.io/gaboose/raspios:trixie-armv7", "localhost:5000/raspios:latest-armv7"},
+		"linux/arm64":  {"raspios:latest-arm64", "ghcr.io/gaboose/raspios:trixie-arm64", "localhost:5000/raspios:latest-arm64"},
+	}, tags)
+
+	tags, err = platformTags("{{.Repo}}-{{.OS}}-{{.Arch}}:{{.Tag}}", []string{"raspios:trixie"}, []string{"linux/arm64"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"linux/arm64": {"raspios-linux-arm64:trixie"}}, tags)
+
+	_, err = platformTags("{{.Repo}}:{{.Tag}}-{{.Arch}}", []string{"raspios"}, platforms)
+	assert.EqualError(t, err, "platforms linux/arm/v6 and linux/arm/v7 are both tagged raspios:latest-arm, set a --platform-tag-template that tells them apart")
+
+	_, err = platformTags("{{.Repo}}:{{.Tag}}", []string{"raspios"}, platforms)
+	assert.EqualError(t, err, "platform linux/arm/v6 is tagged raspios:latest, which is a tag of the manifest")
+
+	_, err = platformTags("{{.Repo", []string{"raspios"}, platforms)
+	assert.ErrorContains(t, err, "invalid platform tag template: ")
+
+	_, err = platformTags("{{.Registry}}", []string{"raspios"}, platforms)
+	assert.ErrorContains(t, err, "failed to execute platform tag template: ")
+}
+
+func TestImageTags(t *testing.T) {
+	platforms := []string{"linux/arm/v6", "linux/arm64"}
+
+	b := &ContainerBuildCmd{PlatformTagTemplate: defaultPlatformTagTemplate, Manifest: "raspios:manifest"}
+	manifest, tags, err := b.imageTags(platforms)
+	require.NoError(t, err)
+	assert.Equal(t, "raspios:manifest", manifest)
+	assert.Equal(t, map[string][]string{}, tags)
+
+	b = &ContainerBuildCmd{PlatformTagTemplate: defaultPlatformTagTemplate, Tag: []string{"raspios:trixie"}}
+	manifest, tags, err = b.imageTags(platforms)
+	require.NoError(t, err)
+	assert.Equal(t, "raspios:trixie", manifest)
+	assert.Equal(t, map[string][]string{
+		"linux/arm/v6": {"raspios:trixie-armv6"},
+		"linux/arm64":  {"raspios:trixie-arm64"},
+	}, tags)
+
+	_, _, err = (&ContainerBuildCmd{}).imageTags(platforms)
+	assert.EqualError(t, err, "--manifest or --tag must be set when building a multiarch image")
+
+	manifest, tags, err = (&ContainerBuildCmd{Manifest: "raspios:manifest"}).imageTags(platforms[1:])
+	require.NoError(t, err)
+	assert.Equal(t, "raspios:manifest", manifest)
+	assert.Equal(t, map[string][]string{"linux/arm64": nil}, tags)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gaboose/pipod/internal/download"
+	"github.com/gaboose/pipod/internal/verify"
+	"github.com/pelletier/go-toml/v2/unstable"
+)
+
+// findRelease runs the update steps of spec and returns the variables they
+// set for the newest release.
+func findRelease(ctx context.Context, d *download.Downloader, spec *Spec) (map[string]string, error) {
+	vars := maps.Clone(spec.Vars)
+	if vars == nil {
+		vars = map[string]string{}
+	}
+
+	release := map[string]string{}
+	for i, step := range spec.Update {
+		index, err := newSpecVars(vars).interpolate(step.Index)
+		if err != nil {
+			return nil, fmt.Errorf("update.%d.index: %w", i, err)
+		}
+
+		page, err := d.ReadFile(ctx, index)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download %s: %w", index, err)
+		}
+
+		match, err := newSpecVars(vars).interpolateRegexp(step.Match)
+		if err != nil {
+			return nil, fmt.Errorf("update.%d.match: %w", i, err)
+		}
+		re, err := regexp.Compile(match)
+		if err != nil {
+			return nil, fmt.Errorf("update.%d.match: %w", i, err)
+		}
+
+		found, err := newestRelease(page, re)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", index, err)
+		}
+
+		maps.Copy(vars, found)
+		maps.Copy(release, found)
+	}
+
+	return release, nil
+}
+
+var hrefRegexp = regexp.MustCompile(`(?i)href\s*=\s*["']([^"']*)["']`)
+
+// newestRelease matches re against the links of an index page and returns
+// the named groups of the newest match. Matches are compared group by group,
+// in the order of the groups.
+func newestRelease(page []byte, re *regexp.Regexp) (map[string]string, error) {
+	var newest []string
+	for _, m := range hrefRegexp.FindAllSubmatch(page, -1) {
+		link := string(m[1])
+		if unescaped, err := url.PathUnescape(link); err == nil {
+			link = unescaped
+		}
+
+		groups := re.FindStringSubmatch(link)
+		if groups != nil && (newest == nil || compareGroups(re, groups, newest) > 0) {
+			newest = groups
+		}
+	}
+
+	if newest == nil {
+		return nil, fmt.Errorf("no link matches %s", re)
+	}
+
+	release := map[string]string{}
+	for i, name := range re.SubexpNames() {
+		if name != "" {
+			release[name] = newest[i]
+		}
+	}
+	return release, nil
+}
+
+func compareGroups(re *regexp.Regexp, a, b []string) int {
+	for i, name := range re.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		if c := compareVersions(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// compareVersions compares a and b like strings, except that runs of digits
+// are compared by their value, so that 1.10 is newer than 1.9.
+func compareVersions(a, b string) int {
+	for a != "" && b != "" {
+		aNum, bNum := leadingDigits(a), leadingDigits(b)
+		if aNum != "" && bNum != "" {
+			aVal, bVal := strings.TrimLeft(aNum, "0"), strings.TrimLeft(bNum, "0")
+			if c := len(aVal) - len(bVal); c != 0 {
+				return c
+			}
+			if c := strings.Compare(aVal, bVal); c != 0 {
+				return c
+			}
+			a, b = a[len(aNum):], b[len(bNum):]
+			continue
+		}
+
+		if a[0] != b[0] {
+			return int(a[0]) - int(b[0])
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) - len(b)
+}
+
+func leadingDigits(s string) string {
+	i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		return s
+	}
+	return s[:i]
+}
+
+// sourceSHA256 returns the sha256 hash of the source of labels. It is read
+// from a published checksum file next to the source if there is one, and
+// computed by fetching the source otherwise.
+func (sf *sourceFetcher) sourceSHA256(ctx context.Context, d *download.Downloader, labels PipodLabels) (string, error) {
+	labels = labels.resolve(sf.dir)
+	sumURL := labels.SourceURL + ".sha256"
+	if data, err := d.ReadFile(ctx, sumURL); err == nil {
+		if sum, err := verify.ParseChecksumFile(data, labels.SourceURL); err == nil {
+			sf.events.Info("Using the checksum published at %s", sumURL)
+			return sum, nil
+		}
+	}
+
+	labels.SourceSHA256 = ""
+	entry, err := sf.fetch(ctx, labels, false)
+	if err != nil {
+		return "", err
+	}
+	entry.Unlock()
+
+	return entry.Meta.SHA256, nil
+}
+
+// setValues replaces the values of keys of the TOML document data with
+// strings, keeping the rest of the document as it is. Keys of values are
+// joined with "\x00", like those of keyLines.
+func setValues(data []byte, values map[string]string) ([]byte, error) {
+	type replacement struct {
+		offset, length int
+		value          string
+	}
+	var replacements []replacement
+	values = maps.Clone(values)
+
+	var addKeyValue func(table []string, expr *unstable.Node)
+	addKeyValue = func(table []string, expr *unstable.Node) {
+		key := slices.Clone(table)
+		for it := expr.Key(); it.Next(); {
+			key = append(key, string(it.Node().Data))
+		}
+
+		value := expr.Value()
+		if value.Kind == unstable.InlineTable {
+			for it := value.Children(); it.Next(); {
+				addKeyValue(key, it.Node())
+			}
+			return
+		}
+
+		if v, ok := values[strings.Join(key, "\x00")]; ok {
+			replacements = append(replacements, replacement{
+				offset: int(value.Raw.Offset),
+				length: int(value.Raw.Length),
+				value:  tomlString(v),
+			})
+			delete(values, strings.Join(key, "\x00"))
+		}
+	}
+
+	var p unstable.Parser
+	p.Reset(data)
+
+	var table []string
+	arrays := map[string]int{}
+	for p.NextExpression() {
+		expr := p.Expression()
+		switch expr.Kind {
+		case unstable.Table, unstable.ArrayTable:
+			table = table[:0]
+			for it := expr.Key(); it.Next(); {
+				table = append(table, string(it.Node().Data))
+			}
+			if expr.Kind == unstable.ArrayTable {
+				table = arrayTableKey(table, arrays)
+			}
+		case unstable.KeyValue:
+			addKeyValue(table, expr)
+		}
+	}
+	if err := p.Error(); err != nil {
+		return nil, fmt.Errorf("failed to parse toml: %w", err)
+	}
+
+	var errs []error
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		errs = append(errs, fmt.Errorf("%s is not set", tomlKey(strings.Split(key, "\x00"))))
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	ret := slices.Clone(data)
+	slices.SortFunc(replacements, func(a, b replacement) int { return b.offset - a.offset })
+	for _, r := range replacements {
+		ret = slices.Replace(ret, r.offset, r.offset+r.length, []byte(r.value)...)
+	}
+	return ret, nil
+}
+
+// tomlString formats s as a TOML basic string.
+func tomlString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, "\\u%04X", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/gaboose/pipod/internal/cache"
+	"github.com/gaboose/pipod/internal/download"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0644))
+	}
+}
+
+func TestSpecUpdate(t *testing.T) {
+	armhfSum := sha256.Sum256([]byte("armhf 1.10"))
+
+	index := t.TempDir()
+	writeFiles(t, index, map[string]string{
+		"images/image-1.9/image-1-arm64.img":         "arm64 1.9",
+		"images/image-1.10/image-2-arm64.img":        "arm64 1.10",
+		"images/image-1.10/image-2-arm64.img.sha256": "79146135607ffe8acac94e5ff501de6fc49583117de5ad08c45a32c73ae2a027  image-2-arm64.img\n",
+		"images/image-1.10/image-2-armhf.img":        "armhf 1.10",
+		"images/image-1.10/image-10-beta.txt":        "",
+		"images/image-1.2/image-3-arm64.img":         "arm64 1.2",
+	})
+	srv := httptest.NewServer(http.FileServer(http.Dir(index)))
+	defer srv.Close()
+
+	specs := t.TempDir()
+	writeFiles(t, specs, map[string]string{
+		"common.toml": `[vars]
+base = "` + srv.URL + `"
+
+[[update]]
+index = "${base}/images/"
+match = '^image-(?P<version>[0-9.]+)/$'
+
+[[update]]
+index = "${base}/images/image-${version}/"
+match = '^image-(?P<build>\d+)-arm64\.img$'
+
+[platform.'linux/arm64'.labels]
+"com.github.gaboose.pipod.source.url" = "${base}/images/image-${version}/image-${build}-arm64.img"
+
+[platform.'linux/arm/v7'.labels]
+"com.github.gaboose.pipod.source.url" = "${base}/images/image-${version}/image-${build}-armhf.img"
+`,
+		"1.9/pipod.toml": `extends = "../common.toml"
+
+# the release
+[vars]
+version = "1.9" # comment
+build = '1'
+
+[platform.'linux/arm64'.labels]
+"com.github.gaboose.pipod.source.sha256" = "0000000000000000000000000000000000000000000000000000000000000000"
+
+[platform.'linux/arm/v7'.labels]
+"com.github.gaboose.pipod.source.sha256" = "0000000000000000000000000000000000000000000000000000000000000000"
+`,
+	})
+
+	sf := &sourceFetcher{cache: cache.New(t.TempDir()), client: http.DefaultClient, events: discardEvents, locks: newKeyLocks()}
+	cmd := SpecUpdateCmd{Spec: filepath.Join(specs, "1.9/pipod.toml"), Out: filepath.Join(specs, "new/1.10/pipod.toml")}
+	require.NoError(t, cmd.update(context.Background(), sf))
+
+	data, err := os.ReadFile(cmd.Out)
+	require.NoError(t, err)
+	assert.Equal(t, `extends = "../../common.toml"
+
+# the release
+[vars]
+version = "1.10" # comment
+build = "2"
+
+[platform.'linux/arm64'.labels]
+"com.github.gaboose.pipod.source.sha256" = "79146135607ffe8acac94e5ff501de6fc49583117de5ad08c45a32c73ae2a027"
+
+[platform.'linux/arm/v7'.labels]
+"com.github.gaboose.pipod.source.sha256" = "`+hex.EncodeToString(armhfSum[:])+`"
+`, string(data))
+
+	cmd = SpecUpdateCmd{Spec: cmd.Out}
+	require.NoError(t, cmd.update(context.Background(), sf))
+	updated, err := os.ReadFile(cmd.Spec)
+	require.NoError(t, err)
+	assert.Equal(t, string(data), string(updated))
+}
+
+func TestNewestRelease(t *testing.T) {
+	page := []byte(`<a href="v1.9.0/">v1.9.0/</a>
+<a HREF='v1.10.0/'>v1.10.0/</a>
+<a href="v1.10.0-rc1/">v1.10.0-rc1/</a>
+<a href="v1.2.10/">v1.2.10/</a>
+<a href="../">../</a>`)
+
+	release, err := newestRelease(page, regexp.MustCompile(`^v(?P<version>[0-9.]+)/$`))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"version": "1.10.0"}, release)
+
+	_, err = newestRelease(page, regexp.MustCompile(`^release-(?P<version>.*)$`))
+	assert.Error(t, err)
+}
+
+func TestCompareVersions(t *testing.T) {
+	assert.Negative(t, compareVersions("1.9", "1.10"))
+	assert.Negative(t, compareVersions("2025-05-13", "2025-10-01"))
+	assert.Negative(t, compareVersions("1.2", "1.2.1"))
+	assert.Positive(t, compareVersions("b", "a10"))
+	assert.Zero(t, compareVersions("1.02", "1.2"))
+}
+
+func TestParseSpecUpdateErrors(t *testing.T) {
+	_, errs := parseSpec("pipod.toml", []byte(`[vars]
+version = "1.0"
+
+[[update]]
+index = "https://example.com/"
+match = '^v(?P<version>.*)/$'
+
+[[update]]
+match = '^v(?P<build>[0-9]+)/$'
+
+[[update]]
+index = "https://example.com/"
+match = '^v([0-9]+/$'
+
+[platform.'linux/arm64'.labels]
+"com.github.gaboose.pipod.source.url" = "https://example.com/image.img.xz"
+`), nil)
+
+	assert.Equal(t, []string{
+		`pipod.toml:8: update.1: no index`,
+		`pipod.toml:9: update.1.match: sets undefined variable "build"`,
+		"pipod.toml:13: update.2.match: error parsing regexp: missing closing ): `^v([0-9]+/$`",
+	}, errorStrings(errs))
+}
+
+func TestFindReleaseSuite(t *testing.T) {
+	index := t.TempDir()
+	writeFiles(t, index, map[string]string{
+		"images/raspios-2025-10-01/2025-10-01-raspios-trixie-arm64-lite.img.xz":   "",
+		"images/raspios-2025-10-01/2025-09-30-raspios-bookworm-arm64-lite.img.xz": "",
+	})
+	srv := httptest.NewServer(http.FileServer(http.Dir(index)))
+	defer srv.Close()
+
+	spec := &Spec{
+		Vars: map[string]string{"base": srv.URL, "release": "2025-05-13", "date": "2025-05-13", "suite": "bookworm"},
+		Update: []UpdateStep{
+			{Index: "${base}/images/", Match: `^raspios-(?P<release>\d{4}-\d{2}-\d{2})/$`},
+			{Index: "${base}/images/raspios-${release}/", Match: `^(?P<date>\d{4}-\d{2}-\d{2})-raspios-${suite}-arm64-lite\.img\.xz$`},
+		},
+	}
+
+	// the suite of the spec, not the newest one
+	release, err := findRelease(context.Background(), download.New(), spec)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"release": "2025-10-01", "date": "2025-09-30"}, release)
+
+	// variables match literally
+	spec.Vars["suite"] = "b.*"
+	_, err = findRelease(context.Background(), download.New(), spec)
+	assert.ErrorContains(t, err, "no link matches")
+}
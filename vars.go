@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var varRegexp = regexp.MustCompile(`\$\$|\$\{([^}]*)\}`)
+
+// interpolate replaces every ${name} in s with the value returned by lookup.
+// $$ is a literal $.
+func interpolate(s string, lookup func(name string) (string, error)) (string, error) {
+	var firstErr error
+	ret := varRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		if m == "$$" {
+			return "$"
+		}
+
+		v, err := lookup(m[2 : len(m)-1])
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return v
+	})
+
+	return ret, firstErr
+}
+
+// specVars resolves variables that may reference each other.
+type specVars struct {
+	raw      map[string]string
+	resolved map[string]string
+	stack    []string
+}
+
+func newSpecVars(raw map[string]string) *specVars {
+	return &specVars{raw: raw, resolved: map[string]string{}}
+}
+
+func (sv *specVars) lookup(name string) (string, error) {
+	if v, ok := sv.resolved[name]; ok {
+		return v, nil
+	}
+
+	raw, ok := sv.raw[name]
+	if !ok {
+		return "", fmt.Errorf("undefined variable %q", name)
+	}
+
+	if slices.Contains(sv.stack, name) {
+		return "", fmt.Errorf("variable %q references itself through %s", name, strings.Join(sv.stack, " -> "))
+	}
+
+	sv.stack = append(sv.stack, name)
+	v, err := interpolate(raw, sv.lookup)
+	sv.stack = sv.stack[:len(sv.stack)-1]
+	if err != nil {
+		return "", err
+	}
+
+	sv.resolved[name] = v
+	return v, nil
+}
+
+// interpolate replaces variables in s.
+func (sv *specVars) interpolate(s string) (string, error) {
+	return interpolate(s, sv.lookup)
+}
+
+// interpolateRegexp replaces variables in the regular expression s with their
+// values matched literally.
+func (sv *specVars) interpolateRegexp(s string) (string, error) {
+	return interpolate(s, func(name string) (string, error) {
+		v, err := sv.lookup(name)
+		return regexp.QuoteMeta(v), err
+	})
+}
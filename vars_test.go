@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSpecVars(t *testing.T) {
+	path := "images/raspios/2025-10-01-trixie-lite/pipod.toml"
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	spec, errs := parseSpec(path, data, nil)
+	require.Empty(t, errs)
+	assert.Equal(t, "https://downloads.raspberrypi.com/raspios_lite_arm64/images/raspios_lite_arm64-2025-10-02/2025-10-01-raspios-trixie-arm64-lite.img.xz", spec.Platform["linux/arm64"].pipod.SourceURL)
+
+	spec, errs = parseSpec(path, data, map[string]string{"date": "2025-11-24", "release": "${date}"})
+	require.Empty(t, errs)
+	assert.Equal(t, "https://downloads.raspberrypi.com/raspios_lite_arm64/images/raspios_lite_arm64-2025-11-24/2025-11-24-raspios-trixie-arm64-lite.img.xz", spec.Platform["linux/arm64"].pipod.SourceURL)
+}
+
+func TestParseSpecVarsErrors(t *testing.T) {
+	_, errs := parseSpec("pipod.toml", []byte(`[vars]
+a = "${b}"
+b = "${a}"
+
+[labels]
+"org.opencontainers.image.version" = "${version}"
+"org.opencontainers.image.title" = "$${literal}"
+
+[platform.'linux/arm64'.labels]
+"com.github.gaboose.pipod.source.url" = "https://example.com/${a}.img"
+`), nil)
+
+	assert.Equal(t, []string{
+		`pipod.toml:2: vars.a: variable "a" references itself through a -> b`,
+		`pipod.toml:3: vars.b: variable "b" references itself through b -> a`,
+		`pipod.toml:6: labels."org.opencontainers.image.version": undefined variable "version"`,
+		`pipod.toml:10: platform."linux/arm64".labels."com.github.gaboose.pipod.source.url": variable "a" references itself through a -> b`,
+	}, errorStrings(errs))
+}
+
+func TestInterpolate(t *testing.T) {
+	sv := newSpecVars(map[string]string{"version": "1.1.0", "tag": "v${version}"})
+
+	got, err := sv.interpolate("image-${tag}-$${tag}-$$")
+	require.NoError(t, err)
+	assert.Equal(t, "image-v1.1.0-${tag}-$", got)
+}
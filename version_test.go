@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildTime(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	created, err := buildTime()
+	require.NoError(t, err)
+	assert.Equal(t, "2023-11-14T22:13:20Z", created.Format(time.RFC3339))
+
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	_, err = buildTime()
+	assert.Error(t, err)
+
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	created, err = buildTime()
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), created, time.Minute)
+}